@@ -56,13 +56,30 @@ function GeminiDb(source, dataHash)
     if (dataHash != undefined) {
         this.dataHash = dataHash;
     }
+
+    // fact column to dimension table and dimension table to key column,
+    // from the meta table if there is one otherwise by naming convention.
+    // measure columns have an empty dimension
+    this.factDims = new Object();
+    this.tableKeys = new Object();
+    if (this.meta != undefined) {
+        for (var i = 0; i < this.meta.data.length; i++) {
+            var row = this.meta.getRowMap(i);
+            this.factDims[row.fact_column] = row.dimension;
+            if (row.dimension != "") {
+                this.tableKeys[row.dimension] = row.key_column;
+            }
+        }
+    }
 }
 
 GeminiDb.prototype.joinFactToDim = function(factRow)  {
     var retVal = new Object();
     for (var factColName in factRow) {        
-        var tableName = factColName.slice(0, -3) + 's';
-        if (factRow[factColName] == -1) {
+        var tableName = this.tableForFactColumn(factColName);
+        if (this.isMeasure(factColName)) {
+            retVal[factColName] = factRow[factColName];
+        } else if (factRow[factColName] == -1) {
             retVal[factColName] = -1;
         } else {
             var dimRow = this[tableName].getRowMap(factRow[factColName]);
@@ -79,7 +96,24 @@ GeminiDb.prototype.factLookup = function(rowNum)  {
     return this.joinFactToDim(factRow);
 };
 
+GeminiDb.prototype.tableForFactColumn = function(factColName) {
+    if (this.factDims[factColName] != undefined) {
+        return this.factDims[factColName];
+    }
+    return factColName.slice(0, -3) + 's';
+};
+
+GeminiDb.prototype.isMeasure = function(factColName) {
+    if (this.factDims[factColName] != undefined) {
+        return this.factDims[factColName] == "";
+    }
+    return factColName.slice(-3) != "_id";
+};
+
 GeminiDb.prototype.idForTable = function(tableName) {
+    if (this.tableKeys[tableName] != undefined) {
+        return this.tableKeys[tableName];
+    }
     return tableName.slice(0, -1) + "_id";
 };
 
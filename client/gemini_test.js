@@ -86,3 +86,62 @@ function testnull() {
 }
 
 testnull();
+
+function testmeta() {
+    var x = new GeminiDb({
+        "fact" : {
+            ColumnNames: ["person_key", "age_id"],
+            Data: [[0, 0], [1, -1]]
+        },
+        "people" : {
+            ColumnNames: ["person_key", "person"],
+            Data: [[0, "tim"], [1, "scarlet"]]
+        },
+        "ages" : {
+            ColumnNames: ["age_id", "age"],
+            Data: [[0, 35]] 
+        },
+        "meta" : {
+            ColumnNames: ["fact_column", "dimension", "key_column", 
+                          "unique_column", "extra_columns", "sort_expr",
+                          "sort_direction"],
+            Data: [["person_key", "people", "person_key", "person", "[]",
+                    "\"person\"", "asc"],
+                   ["age_id", "ages", "age_id", "age", "[]", "\"age\"", "asc"]]
+        }
+    });
+    printobject(x.factLookup(0));
+    var z = x.newQuery().addFromTable('people', 'ages');
+    printobjectarray(z.simplesort());
+    printGeminiResult(z.slicendice());
+}
+
+testmeta();
+
+function testmeasure() {
+    var x = new GeminiDb({
+        "fact" : {
+            ColumnNames: ["name_id", "distance"],
+            Data: [[0, 2.5], [1, -1], [0, null]]
+        },
+        "names" : {
+            ColumnNames: ["name_id", "name"],
+            Data: [[0, "tim"], [1, "scarlet"]]
+        },
+        "meta" : {
+            ColumnNames: ["fact_column", "dimension", "key_column", 
+                          "unique_column", "extra_columns", "sort_expr",
+                          "sort_direction"],
+            Data: [["name_id", "names", "name_id", "name", "[]",
+                    "\"name\"", "asc"],
+                   ["distance", "", "", "", "[]", "", ""]]
+        }
+    });
+    for (var i = 0; i < x.fact.data.length; i++) {
+        printobject(x.factLookup(i));
+    }
+    var z = x.newQuery().addFromTable('names');
+    printobjectarray(z.simplesort());
+}
+
+testmeasure();
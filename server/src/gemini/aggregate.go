@@ -0,0 +1,303 @@
+package gemini
+
+import (
+    "fmt"
+    "sort"
+)
+
+// Fact table grouping for summaries. The fact table gets a row per
+// distinct combination of the Dimensions' ids, sorted by id, holding the
+// ids and then the Aggregates. Dimension tables not grouped by are left out
+// of the TableSet and the aggregates are measures in the meta table. A
+// dimension with more than one row for a unique value is an error, as its
+// source rows have a fact row for each.
+type Aggregation struct {
+    // names of the dimension tables to group by, eg. "route_short_names",
+    // none gives a single row of totals
+    Dimensions []string
+    Aggregates []Aggregate
+}
+
+type Aggregate struct {
+    // one of AggregateCount, AggregateSum, AggregateMin, AggregateMax or
+    // AggregateAvg
+    Function string
+    // Measure column aggregated, may be empty for AggregateCount to count
+    // fact rows
+    Column string
+    // fact table column name, Function_Column or just Function if not set
+    Name string
+}
+
+// Aggregate Function values. NULL values are ignored, sum, min, max and avg
+// are NULL if a group has no values.
+const (
+    // number of values, integer
+    AggregateCount string = "count"
+    // integer for integer columns, float otherwise
+    AggregateSum string = "sum"
+    AggregateMin string = "min"
+    AggregateMax string = "max"
+    // float
+    AggregateAvg string = "avg"
+)
+
+// aggregate with its fact table column
+type factAggregate struct {
+    Aggregate
+    column int
+    datatype ColumnDatatype
+}
+
+type aggregateState struct {
+    count int64
+    intSum int64
+    floatSum float64
+    min, max interface{}
+}
+
+func (s *aggregateState) add(v interface{}, column int) {
+    if column == -1 {
+        s.count++
+        return
+    }
+    if v == nil {
+        return
+    }
+    s.count++
+    switch v := v.(type) {
+        case int64:
+            s.intSum += v
+            s.floatSum += float64(v)
+        case float64:
+            s.floatSum += v
+    }
+    if s.min == nil || compareValues(v, s.min) < 0 {
+        s.min = v
+    }
+    if s.max == nil || compareValues(v, s.max) > 0 {
+        s.max = v
+    }
+}
+
+func (s *aggregateState) value(a *factAggregate) interface{} {
+    if a.Function == AggregateCount {
+        return s.count
+    }
+    if s.count == 0 {
+        return nil
+    }
+    switch a.Function {
+        case AggregateSum:
+            if a.datatype == IntegerDatatype {
+                return s.intSum
+            }
+            return s.floatSum
+        case AggregateMin:
+            return s.min
+        case AggregateMax:
+            return s.max
+    }
+    return s.floatSum / float64(s.count)
+}
+
+type aggregateGroup struct {
+    key []int64
+    states []aggregateState
+}
+
+type groupOrder []*aggregateGroup
+
+func (o groupOrder) Len() int {
+    return len(o)
+}
+
+func (o groupOrder) Less(i, j int) bool {
+    return keyOrder{o[i].key, o[j].key}.Less(0, 1)
+}
+
+func (o groupOrder) Swap(i, j int) {
+    o[i], o[j] = o[j], o[i]
+}
+
+// Replace the fact table with its Aggregation
+func (d *Datamart) aggregateFact(tables TableSet,
+                                 dimDefs map[string]*DimensionDefinition) (TableSet, error) {
+    grouped := make(map[string]*DimensionDefinition)
+    for _, name := range d.Aggregation.Dimensions {
+        dim, ok := dimDefs[name]
+        if !ok {
+            return nil, fmt.Errorf("aggregateFact() error, unknown dimension %s\n", name)
+        }
+        grouped[name] = dim
+    }
+    names := orderedDimNames(grouped)
+    err := checkDimsUnique(tables, dimDefs)
+    if err != nil {
+        return nil, err
+    }
+
+    fact := tables["fact"]
+    rows, err := tableRows(fact)
+    if err != nil {
+        return nil, err
+    }
+    // a fact table without rows has no columns
+    factIndex := func(column string) int {
+        if len(rows) == 0 {
+            return 0
+        }
+        return fact.columnIndex(column)
+    }
+
+    info := &Table{}
+    keyIndex := make([]int, len(names))
+    for i, name := range names {
+        keyIndex[i] = factIndex(grouped[name].IndexColumn)
+        info.ColumnNames = append(info.ColumnNames, grouped[name].IndexColumn)
+        info.ColumnTypes = append(info.ColumnTypes, IntegerDatatype)
+    }
+    aggs, err := d.factAggregates(factIndex)
+    if err != nil {
+        return nil, err
+    }
+    var aggNames []string
+    for _, a := range aggs {
+        for _, name := range info.ColumnNames {
+            if name == a.Name {
+                return nil, fmt.Errorf("aggregateFact() error, duplicate column %s\n", name)
+            }
+        }
+        datatype := a.datatype
+        switch a.Function {
+            case AggregateCount:
+                datatype = IntegerDatatype
+            case AggregateAvg:
+                datatype = FloatDatatype
+        }
+        info.ColumnNames = append(info.ColumnNames, a.Name)
+        info.ColumnTypes = append(info.ColumnTypes, datatype)
+        aggNames = append(aggNames, a.Name)
+    }
+
+    groups := make(map[string]*aggregateGroup)
+    var order groupOrder
+    // with no dimensions there is a row of totals even without fact rows
+    if len(names) == 0 {
+        group := &aggregateGroup{key : []int64{}, states : make([]aggregateState, len(aggs))}
+        groups[fmt.Sprint(group.key)] = group
+        order = append(order, group)
+    }
+    for _, row := range rows {
+        key := make([]int64, len(keyIndex))
+        for i, column := range keyIndex {
+            key[i] = row[column].(int64)
+        }
+        k := fmt.Sprint(key)
+        group, ok := groups[k]
+        if !ok {
+            group = &aggregateGroup{key : key, states : make([]aggregateState, len(aggs))}
+            groups[k] = group
+            order = append(order, group)
+        }
+        for i, a := range aggs {
+            var v interface{}
+            if a.column != -1 {
+                v = row[a.column]
+            }
+            group.states[i].add(v, a.column)
+        }
+    }
+    sort.Sort(order)
+
+    info.initData()
+    for _, group := range order {
+        values := make([]interface{}, 0, len(info.ColumnNames))
+        for _, id := range group.key {
+            values = append(values, id)
+        }
+        for i := range aggs {
+            values = append(values, group.states[i].value(&aggs[i]))
+        }
+        err = info.writeRow(values)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    ret := TableSet{"fact" : info}
+    for _, name := range names {
+        ret[name] = tables[name]
+    }
+    ret[MetaTable], err = metaTable(grouped, aggNames)
+    if err != nil {
+        return nil, err
+    }
+    return ret, nil
+}
+
+// A dimension with several rows for a unique value, as a SortExpr or extra
+// column varying between source rows gives, has a fact row for each of them
+// and aggregates would count the source row more than once
+func checkDimsUnique(tables TableSet, dimDefs map[string]*DimensionDefinition) error {
+    for _, name := range orderedDimNames(dimDefs) {
+        rows, err := tableRows(tables[name])
+        if err != nil {
+            return err
+        }
+        seen := make(map[string]bool)
+        for _, row := range rows {
+            key := valueKey(row[1])
+            if seen[key] {
+                return fmt.Errorf("aggregateFact() error, %s has more than one row for %s %v\n",
+                                  name,
+                                  dimDefs[name].UniqueColumn,
+                                  row[1])
+            }
+            seen[key] = true
+        }
+    }
+    return nil
+}
+
+// check the Aggregates and find their fact table columns
+func (d *Datamart) factAggregates(factIndex func(string) int) ([]factAggregate, error) {
+    src := d.SourceTableData
+    aggs := make([]factAggregate, len(d.Aggregation.Aggregates))
+    for i, a := range d.Aggregation.Aggregates {
+        agg := &aggs[i]
+        agg.Aggregate = a
+        agg.column = -1
+        switch a.Function {
+            case AggregateCount, AggregateSum, AggregateMin, AggregateMax, AggregateAvg:
+            default:
+                return nil, fmt.Errorf("aggregateFact() error, unknown function %q\n", a.Function)
+        }
+        if agg.Name == "" {
+            agg.Name = a.Function
+            if a.Column != "" {
+                agg.Name += "_" + a.Column
+            }
+        }
+        if a.Column == "" {
+            if a.Function != AggregateCount {
+                return nil, fmt.Errorf("aggregateFact() error, %s needs a column\n", a.Function)
+            }
+            continue
+        }
+
+        source := src.columnIndex(a.Column)
+        if source == -1 || !d.SourceColumnProperties[a.Column].Measure {
+            return nil, fmt.Errorf("aggregateFact() error, %s is not a measure\n", a.Column)
+        }
+        agg.column = factIndex(a.Column)
+        agg.datatype = src.ColumnTypes[source]
+        if agg.datatype == StringDatatype &&
+           (a.Function == AggregateSum || a.Function == AggregateAvg) {
+            return nil, fmt.Errorf("aggregateFact() error, can't %s string column %s\n",
+                                   a.Function,
+                                   a.Column)
+        }
+    }
+    return aggs, nil
+}
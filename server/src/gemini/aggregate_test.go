@@ -0,0 +1,176 @@
+package gemini
+
+import (
+    "reflect"
+    "testing"
+)
+
+var aggregateTests = []struct {
+    dimensions []string
+    columnNames []string
+    rows [][]interface{}
+}{
+    {
+        []string{"routes"},
+        []string{"route_id", "count", "sum_distance", "avg_fare", "min_fare", "fares"},
+        [][]interface{}{
+            {int64(-1), int64(1), nil, 100.0, int64(100), int64(1)},
+            {int64(0), int64(1), 2.0, nil, nil, int64(0)},
+            {int64(1), int64(3), 4.5, 250.0, int64(200), int64(3)},
+        },
+    },
+    {
+        []string{"stops", "routes"},
+        []string{"route_id", "stop_id", "count", "sum_distance", "avg_fare", "min_fare", "fares"},
+        [][]interface{}{
+            {int64(-1), int64(0), int64(1), nil, 100.0, int64(100), int64(1)},
+            {int64(0), int64(1), int64(1), 2.0, nil, nil, int64(0)},
+            {int64(1), int64(0), int64(2), 2.0, 275.0, int64(250), int64(2)},
+            {int64(1), int64(1), int64(1), 2.5, 200.0, int64(200), int64(1)},
+        },
+    },
+    {
+        nil,
+        []string{"count", "sum_distance", "avg_fare", "min_fare", "fares"},
+        [][]interface{}{
+            {int64(5), 6.5, 212.5, int64(100), int64(4)},
+        },
+    },
+}
+
+func TestPerformQueriesAggregation(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route", "stop", "distance", "fare"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            StringDatatype,
+            FloatDatatype,
+            IntegerDatatype,
+        },
+    }
+    info.initData()
+    for _, row := range [][]interface{}{
+        {"2", "a", 1.5, 300},
+        {"10", "b", 2.0, nil},
+        {"2", "b", 2.5, 200},
+        {nil, "a", nil, 100},
+        {"2", "a", 0.5, 250},
+    } {
+        fatalOnError(info.writeRow(row), t)
+    }
+    for _, engine := range []string{SqliteEngine, GoEngine} {
+        for _, test := range aggregateTests {
+            d := &Datamart{
+                SourceTableData: info,
+                SourceColumnProperties: map[string]SourceColumnProperty{
+                    "distance" : SourceColumnProperty{Measure: true},
+                    "fare" : SourceColumnProperty{Measure: true},
+                },
+                Engine: engine,
+                Aggregation: &Aggregation{
+                    Dimensions: test.dimensions,
+                    Aggregates: []Aggregate{
+                        {Function: AggregateCount},
+                        {Function: AggregateSum, Column: "distance"},
+                        {Function: AggregateAvg, Column: "fare"},
+                        {Function: AggregateMin, Column: "fare"},
+                        {Function: AggregateCount, Column: "fare", Name: "fares"},
+                    },
+                },
+            }
+            tables, err := d.PerformQueries()
+            fatalOnError(err, t)
+            fact := tables["fact"]
+            if !reflect.DeepEqual(fact.ColumnNames, test.columnNames) {
+                t.Errorf("%s %v: fact columns %v expected %v",
+                         engine, test.dimensions, fact.ColumnNames, test.columnNames)
+            }
+            rows, err := tableRows(fact)
+            fatalOnError(err, t)
+            if !reflect.DeepEqual(rows, test.rows) {
+                t.Errorf("%s %v: fact rows %v expected %v",
+                         engine, test.dimensions, rows, test.rows)
+            }
+            if len(tables) != len(test.dimensions) + 2 {
+                t.Errorf("%s %v: tables %v", engine, test.dimensions, tables.Names())
+            }
+            columns, err := tables.FactColumns()
+            fatalOnError(err, t)
+            if len(columns) != len(test.columnNames) ||
+               !columns[len(columns) - 1].Measure {
+                t.Errorf("%s %v: meta %+v", engine, test.dimensions, columns)
+            }
+        }
+    }
+}
+
+func TestPerformQueriesAggregationErrors(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route", "stop", "distance"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, StringDatatype, FloatDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"2", "a", 1.5}, {"10", "b", 2.0}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    for _, agg := range []Aggregation{
+        {Dimensions: []string{"heights"}},
+        {Aggregates: []Aggregate{{Function: "median", Column: "distance"}}},
+        {Aggregates: []Aggregate{{Function: AggregateSum}}},
+        {Aggregates: []Aggregate{{Function: AggregateSum, Column: "route"}}},
+        {Aggregates: []Aggregate{{Function: AggregateAvg, Column: "stop"}}},
+        {
+            Dimensions: []string{"routes"},
+            Aggregates: []Aggregate{{Function: AggregateCount, Name: "route_id"}},
+        },
+    } {
+        agg := agg
+        d := &Datamart{
+            SourceTableData: info,
+            SourceColumnProperties: map[string]SourceColumnProperty{
+                "stop" : SourceColumnProperty{Measure: true},
+                "distance" : SourceColumnProperty{Measure: true},
+            },
+            Aggregation: &agg,
+        }
+        if _, err := d.PerformQueries(); err == nil {
+            t.Errorf("expected error for %+v", agg)
+        }
+    }
+}
+
+// stops sorted by distance have a row per distinct (stop, distance), the
+// fact table a row for each and the source row would be counted twice
+func TestPerformQueriesAggregationDuplicateRows(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route", "stop", "distance"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, StringDatatype, FloatDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"2", "a", 1.5}, {"2", "a", 0.5}, {"10", "b", 2.0}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    for _, engine := range []string{SqliteEngine, GoEngine} {
+        d := &Datamart{
+            SourceTableData: info,
+            SourceColumnProperties: map[string]SourceColumnProperty{
+                "stop" : SourceColumnProperty{SortExpr: "distance"},
+            },
+            Engine: engine,
+            Aggregation: &Aggregation{
+                Dimensions: []string{"routes"},
+                Aggregates: []Aggregate{{Function: AggregateCount}},
+            },
+        }
+        _, err := d.PerformQueries()
+        if err == nil {
+            t.Errorf("%s: expected error for stops with several rows", engine)
+        }
+
+        // without duplicate rows the same grouping is fine
+        d.SourceColumnProperties["stop"] = SourceColumnProperty{}
+        d.SourceColumnProperties["distance"] = SourceColumnProperty{Measure: true}
+        _, err = d.PerformQueries()
+        fatalOnError(err, t)
+    }
+}
@@ -0,0 +1,567 @@
+package gemini
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "runtime"
+    "strconv"
+)
+
+// Tables in the Apache Arrow IPC streaming format
+//
+// A stream is a schema message, record batch messages and an end of stream
+// marker. Each message is a Message.fbs flatbuffer preceded by a
+// continuation marker and its length, followed by a body holding the
+// column buffers. Column datatypes are written as:
+//
+// integer: Int(64, signed)
+// float:   FloatingPoint(DOUBLE)
+// string:  Utf8
+//
+// NULLs are marked in each column's validity bitmap. When reading, signed
+// and unsigned Int of any width, FloatingPoint SINGLE and DOUBLE, Utf8,
+// Binary and Null columns are accepted.
+
+const (
+    arrowContinuation = 0xffffffff
+    arrowMetadataV5 = 4
+    arrowBatchRows = 64 * 1024
+    arrowTableNameKey = "gemini.table_name"
+
+    // MessageHeader union
+    arrowHeaderSchema = 1
+    arrowHeaderRecordBatch = 3
+
+    // Type union
+    arrowTypeNull = 1
+    arrowTypeInt = 2
+    arrowTypeFloatingPoint = 3
+    arrowTypeBinary = 4
+    arrowTypeUtf8 = 5
+
+    // FloatingPoint precision
+    arrowPrecisionSingle = 1
+    arrowPrecisionDouble = 2
+)
+
+// Write table as an Arrow IPC stream
+func (t *Table) ArrowWrite(w io.Writer) error {
+    return t.arrowWrite(w, "")
+}
+
+// Write each table of the set as an Arrow IPC stream, one after another.
+// The table name is kept in the schema metadata under "gemini.table_name".
+func (t TableSet) ArrowWrite(w io.Writer) error {
+    for _, k := range t.Names() {
+        err := t[k].arrowWrite(w, k)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (t *Table) arrowWrite(w io.Writer, name string) error {
+    err := writeArrowMessage(w, arrowHeaderSchema, t.arrowSchema(name), nil)
+    if err != nil {
+        return err
+    }
+
+    for start := 0; start < t.rowCount(); start += arrowBatchRows {
+        end := start + arrowBatchRows
+        if end > t.rowCount() {
+            end = t.rowCount()
+        }
+        header, body, err := t.arrowRecordBatch(start, end)
+        if err != nil {
+            return err
+        }
+        err = writeArrowMessage(w, arrowHeaderRecordBatch, header, body)
+        if err != nil {
+            return err
+        }
+    }
+
+    // end of stream
+    _, err = w.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+    return err
+}
+
+func (t *Table) arrowSchema(name string) []fbField {
+    fields := make([][]fbField, len(t.ColumnNames))
+    for i := 0; i < len(fields); i++ {
+        var typeType uint8
+        var typeFields []fbField
+        switch t.ColumnTypes[i] {
+            case IntegerDatatype:
+                typeType = arrowTypeInt
+                typeFields = []fbField{
+                    {slot: 0, scalar: fbInt32(64)},
+                    {slot: 1, scalar: []byte{1}},
+                }
+            case FloatDatatype:
+                typeType = arrowTypeFloatingPoint
+                typeFields = []fbField{
+                    {slot: 0, scalar: fbInt16(arrowPrecisionDouble)},
+                }
+            case StringDatatype:
+                typeType = arrowTypeUtf8
+        }
+        fields[i] = []fbField{
+            {slot: 0, child: fbString(t.ColumnNames[i])},
+            {slot: 1, scalar: []byte{1}},
+            {slot: 2, scalar: []byte{typeType}},
+            {slot: 3, child: fbTableRef(typeFields)},
+            {slot: 5, child: fbTableVector(nil)},
+        }
+    }
+
+    schema := []fbField{
+        {slot: 0, scalar: fbInt16(0)},
+        {slot: 1, child: fbTableVector(fields)},
+    }
+    if name != "" {
+        schema = append(schema, fbField{
+            slot: 2,
+            child: fbTableVector([][]fbField{
+                {
+                    {slot: 0, child: fbString(arrowTableNameKey)},
+                    {slot: 1, child: fbString(name)},
+                },
+            }),
+        })
+    }
+    return schema
+}
+
+// Make record batch header and body for rows start to end
+func (t *Table) arrowRecordBatch(start, end int) ([]fbField, []byte, error) {
+    n := end - start
+    cols := len(t.ColumnTypes)
+    validity := make([][]byte, cols)
+    nullCounts := make([]int, cols)
+    data := make([][]byte, cols)
+    offsets := make([][]byte, cols)
+    for j := 0; j < cols; j++ {
+        validity[j] = make([]byte, (n + 7) / 8)
+        switch t.ColumnTypes[j] {
+            case IntegerDatatype, FloatDatatype:
+                data[j] = make([]byte, 8 * n)
+            case StringDatatype:
+                offsets[j] = make([]byte, 4 * (n + 1))
+        }
+    }
+
+    row := make([]*interface{}, cols)
+    for j := 0; j < cols; j++ {
+        row[j] = new(interface{})
+    }
+    for i := 0; i < n; i++ {
+        err := t.readRow(start + i, row)
+        if err != nil {
+            return nil, nil, err
+        }
+        for j := 0; j < cols; j++ {
+            value := *row[j]
+            if value == nil {
+                nullCounts[j]++
+            } else {
+                validity[j][i / 8] |= 1 << uint(i % 8)
+                switch t.ColumnTypes[j] {
+                    case IntegerDatatype:
+                        binary.LittleEndian.PutUint64(
+                            data[j][i * 8:],
+                            uint64(value.(int64)),
+                        )
+                    case FloatDatatype:
+                        binary.LittleEndian.PutUint64(
+                            data[j][i * 8:],
+                            math.Float64bits(value.(float64)),
+                        )
+                    case StringDatatype:
+                        data[j] = append(data[j], value.(string)...)
+                }
+            }
+            if t.ColumnTypes[j] == StringDatatype {
+                binary.LittleEndian.PutUint32(
+                    offsets[j][(i + 1) * 4:],
+                    uint32(len(data[j])),
+                )
+            }
+        }
+    }
+
+    // body buffers are 8 byte aligned, a column without nulls gets an
+    // empty validity buffer
+    var body []byte
+    var nodes, buffers []int64
+    addBuffer := func(b []byte) {
+        buffers = append(buffers, int64(len(body)), int64(len(b)))
+        body = append(body, b...)
+        for len(body) % 8 != 0 {
+            body = append(body, 0)
+        }
+    }
+    for j := 0; j < cols; j++ {
+        nodes = append(nodes, int64(n), int64(nullCounts[j]))
+        if nullCounts[j] == 0 {
+            addBuffer(nil)
+        } else {
+            addBuffer(validity[j])
+        }
+        if t.ColumnTypes[j] == StringDatatype {
+            addBuffer(offsets[j])
+        }
+        addBuffer(data[j])
+    }
+
+    header := []fbField{
+        {slot: 0, scalar: fbInt64(int64(n))},
+        {slot: 1, child: fbStructVector(nodes)},
+        {slot: 2, child: fbStructVector(buffers)},
+    }
+    return header, body, nil
+}
+
+func writeArrowMessage(w io.Writer, headerType uint8, header []fbField,
+                       body []byte) error {
+    var b fbBuilder
+    meta := b.finish([]fbField{
+        {slot: 0, scalar: fbInt16(arrowMetadataV5)},
+        {slot: 1, scalar: []byte{headerType}},
+        {slot: 2, child: fbTableRef(header)},
+        {slot: 3, scalar: fbInt64(int64(len(body)))},
+    })
+
+    prefix := make([]byte, 8)
+    binary.LittleEndian.PutUint32(prefix, arrowContinuation)
+    binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)))
+    _, err := w.Write(prefix)
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(meta)
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(body)
+    return err
+}
+
+// Load table from an Arrow IPC stream
+func LoadTableFromArrow(r io.Reader) (*Table, error) {
+    info, _, err := loadArrowStream(r)
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    return info, err
+}
+
+// Load table set from Arrow IPC streams written one after another, as
+// written by TableSet.ArrowWrite. A stream without a table name in its
+// schema metadata is named "table<i>".
+func LoadTableSetFromArrow(r io.Reader) (TableSet, error) {
+    ret := make(TableSet)
+    for i := 0;; i++ {
+        info, name, err := loadArrowStream(r)
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        if name == "" {
+            name = fmt.Sprintf("table%d", i)
+        }
+        if _, ok := ret[name]; ok {
+            return nil, fmt.Errorf(
+                "LoadTableSetFromArrow duplicate table name %s\n",
+                name,
+            )
+        }
+        ret[name] = info
+    }
+    return ret, nil
+}
+
+type arrowColumn struct {
+    typeType uint8
+    bitWidth int
+    signed bool
+}
+
+// Read one stream, returns io.EOF if there is no stream left to read
+func loadArrowStream(r io.Reader) (info *Table, name string, err error) {
+    defer recoverArrowError(&err)
+
+    msg, _, err := readArrowMessage(r)
+    if err != nil {
+        return nil, "", err
+    }
+    if msg == nil {
+        return nil, "", errors.New("LoadTableFromArrow missing schema")
+    }
+    if msg.uint8(1, 0) != arrowHeaderSchema {
+        return nil, "", errors.New("LoadTableFromArrow expected schema")
+    }
+    schema, ok := msg.table(2)
+    if !ok {
+        return nil, "", errors.New("LoadTableFromArrow missing schema")
+    }
+
+    metaStart, metaLen := schema.vector(2)
+    for i := 0; i < metaLen; i++ {
+        kv := schema.tableAt(metaStart, i)
+        if kv.string(0) == arrowTableNameKey {
+            name = kv.string(1)
+        }
+    }
+
+    info = new(Table)
+    fieldStart, fieldLen := schema.vector(1)
+    info.ColumnNames = make([]string, fieldLen)
+    info.ColumnTypes = make([]ColumnDatatype, fieldLen)
+    columns := make([]arrowColumn, fieldLen)
+    for i := 0; i < fieldLen; i++ {
+        field := schema.tableAt(fieldStart, i)
+        info.ColumnNames[i] = field.string(0)
+        columns[i].typeType = field.uint8(2, 0)
+        fieldType, _ := field.table(3)
+        switch columns[i].typeType {
+            case arrowTypeInt:
+                columns[i].bitWidth = int(fieldType.int32(0, 0))
+                columns[i].signed = fieldType.uint8(1, 0) != 0
+                switch columns[i].bitWidth {
+                    case 8, 16, 32, 64:
+                    default:
+                        return nil, "", fmt.Errorf(
+                            "LoadTableFromArrow unsupported int width %d\n",
+                            columns[i].bitWidth,
+                        )
+                }
+                info.ColumnTypes[i] = IntegerDatatype
+            case arrowTypeFloatingPoint:
+                switch fieldType.int16(0, 0) {
+                    case arrowPrecisionSingle:
+                        columns[i].bitWidth = 32
+                    case arrowPrecisionDouble:
+                        columns[i].bitWidth = 64
+                    default:
+                        return nil, "", errors.New(
+                            "LoadTableFromArrow unsupported float precision\n",
+                        )
+                }
+                info.ColumnTypes[i] = FloatDatatype
+            case arrowTypeUtf8, arrowTypeBinary, arrowTypeNull:
+                info.ColumnTypes[i] = StringDatatype
+            default:
+                return nil, "", fmt.Errorf(
+                    "LoadTableFromArrow unsupported type %d column %s\n",
+                    columns[i].typeType,
+                    info.ColumnNames[i],
+                )
+        }
+    }
+
+    info.initData()
+    for {
+        msg, body, err := readArrowMessage(r)
+        if err == io.EOF {
+            // stream without end of stream marker
+            break
+        }
+        if err != nil {
+            return nil, "", err
+        }
+        if msg == nil {
+            break
+        }
+        if msg.uint8(1, 0) != arrowHeaderRecordBatch {
+            return nil, "", fmt.Errorf(
+                "LoadTableFromArrow unsupported message type %d\n",
+                msg.uint8(1, 0),
+            )
+        }
+        batch, ok := msg.table(2)
+        if !ok {
+            return nil, "", errors.New("LoadTableFromArrow missing record batch")
+        }
+        err = info.loadArrowRecordBatch(columns, batch, body)
+        if err != nil {
+            return nil, "", err
+        }
+    }
+
+    return info, name, nil
+}
+
+func (t *Table) loadArrowRecordBatch(columns []arrowColumn, batch *fbTable,
+                                     body []byte) error {
+    if _, ok := batch.table(3); ok {
+        return errors.New("LoadTableFromArrow compressed bodies not supported")
+    }
+    n := int(batch.int64(0, 0))
+    nodeStart, nodeLen := batch.vector(1)
+    bufStart, bufLen := batch.vector(2)
+    if nodeLen != len(columns) {
+        return errors.New("LoadTableFromArrow field node count mismatch")
+    }
+
+    // buffers of each column, Null has none, Utf8 and Binary have three
+    validity := make([][]byte, len(columns))
+    offsets := make([][]byte, len(columns))
+    data := make([][]byte, len(columns))
+    buffer := 0
+    nextBuffer := func() []byte {
+        if buffer >= bufLen {
+            panic(errors.New("LoadTableFromArrow buffer count mismatch"))
+        }
+        offset := batch.structInt64(bufStart, buffer, 0)
+        length := batch.structInt64(bufStart, buffer, 1)
+        buffer++
+        return body[offset:offset + length]
+    }
+    for j, col := range columns {
+        if batch.structInt64(nodeStart, j, 0) != int64(n) {
+            return errors.New("LoadTableFromArrow field length mismatch")
+        }
+        if col.typeType == arrowTypeNull {
+            continue
+        }
+        validity[j] = nextBuffer()
+        if col.typeType == arrowTypeUtf8 || col.typeType == arrowTypeBinary {
+            offsets[j] = nextBuffer()
+        }
+        data[j] = nextBuffer()
+    }
+
+    values := make([]interface{}, len(columns))
+    for i := 0; i < n; i++ {
+        for j, col := range columns {
+            values[j] = nil
+            if col.typeType == arrowTypeNull {
+                continue
+            }
+            if len(validity[j]) > 0 && validity[j][i / 8] & (1 << uint(i % 8)) == 0 {
+                continue
+            }
+            switch col.typeType {
+                case arrowTypeInt:
+                    value, err := arrowInteger(data[j], i, col)
+                    if err != nil {
+                        return err
+                    }
+                    values[j] = value
+                case arrowTypeFloatingPoint:
+                    if col.bitWidth == 32 {
+                        bits := binary.LittleEndian.Uint32(data[j][i * 4:])
+                        values[j] = widenFloat32(math.Float32frombits(bits))
+                    } else {
+                        bits := binary.LittleEndian.Uint64(data[j][i * 8:])
+                        values[j] = math.Float64frombits(bits)
+                    }
+                case arrowTypeUtf8, arrowTypeBinary:
+                    from := binary.LittleEndian.Uint32(offsets[j][i * 4:])
+                    to := binary.LittleEndian.Uint32(offsets[j][(i + 1) * 4:])
+                    values[j] = string(data[j][from:to])
+            }
+        }
+        err := t.writeRow(values)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func arrowInteger(data []byte, i int, col arrowColumn) (int64, error) {
+    switch col.bitWidth {
+        case 8:
+            if col.signed {
+                return int64(int8(data[i])), nil
+            }
+            return int64(data[i]), nil
+        case 16:
+            v := binary.LittleEndian.Uint16(data[i * 2:])
+            if col.signed {
+                return int64(int16(v)), nil
+            }
+            return int64(v), nil
+        case 32:
+            v := binary.LittleEndian.Uint32(data[i * 4:])
+            if col.signed {
+                return int64(int32(v)), nil
+            }
+            return int64(v), nil
+    }
+    v := binary.LittleEndian.Uint64(data[i * 8:])
+    if col.signed {
+        return int64(v), nil
+    }
+    return checkedUint64(v)
+}
+
+// Read next message, returns nil message at end of stream marker and io.EOF
+// if there is nothing left to read
+func readArrowMessage(r io.Reader) (*fbTable, []byte, error) {
+    word := make([]byte, 4)
+    _, err := io.ReadFull(r, word)
+    if err != nil {
+        return nil, nil, err
+    }
+    length := binary.LittleEndian.Uint32(word)
+    if length == arrowContinuation {
+        _, err = io.ReadFull(r, word)
+        if err != nil {
+            return nil, nil, io.ErrUnexpectedEOF
+        }
+        length = binary.LittleEndian.Uint32(word)
+    }
+    if length == 0 {
+        return nil, nil, nil
+    }
+    if length > math.MaxInt32 {
+        return nil, nil, errors.New("LoadTableFromArrow bad message length")
+    }
+
+    meta := make([]byte, length)
+    _, err = io.ReadFull(r, meta)
+    if err != nil {
+        return nil, nil, io.ErrUnexpectedEOF
+    }
+    msg := fbRoot(meta)
+
+    bodyLength := msg.int64(3, 0)
+    if bodyLength < 0 || bodyLength > math.MaxInt32 {
+        return nil, nil, errors.New("LoadTableFromArrow bad body length")
+    }
+    body := make([]byte, bodyLength)
+    _, err = io.ReadFull(r, body)
+    if err != nil {
+        return nil, nil, io.ErrUnexpectedEOF
+    }
+    return msg, body, nil
+}
+
+// Out of range reads of a malformed message panic, return them as errors
+func recoverArrowError(err *error) {
+    if r := recover(); r != nil {
+        switch e := r.(type) {
+            case runtime.Error:
+                *err = errors.New("LoadTableFromArrow malformed message")
+            case error:
+                *err = e
+            default:
+                panic(r)
+        }
+    }
+}
+
+// Float32 to float64 via shortest text form, so 0.1 stays 0.1
+func widenFloat32(f float32) float64 {
+    v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+    return v
+}
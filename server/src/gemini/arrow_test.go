@@ -0,0 +1,113 @@
+package gemini
+
+import (
+    "testing"
+    "bytes"
+    "reflect"
+)
+
+func TestArrowRoundTrip(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"name", "age", "height"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            IntegerDatatype,
+            FloatDatatype,
+        },
+    }
+    info.initData()
+    for _, row := range [][]interface{}{
+        {"tim", 5, 1.1},
+        {nil, -4, nil},
+        {"lao", nil, 1.5},
+        {"", 1 << 40, -0.25},
+    } {
+        fatalOnError(info.writeRow(row), t)
+    }
+    var buf bytes.Buffer
+    err := info.ArrowWrite(&buf)
+    fatalOnError(err, t)
+
+    loaded, err := LoadTableFromArrow(&buf)
+    fatalOnError(err, t)
+    if !reflect.DeepEqual(loaded.ColumnNames, info.ColumnNames) ||
+       !reflect.DeepEqual(loaded.ColumnTypes, info.ColumnTypes) {
+        t.Fatalf("columns %v %v", loaded.ColumnNames, loaded.ColumnTypes)
+    }
+    expected, err := tableRows(info)
+    fatalOnError(err, t)
+    rows, err := tableRows(loaded)
+    fatalOnError(err, t)
+    if !reflect.DeepEqual(rows, expected) {
+        t.Errorf("rows %v expected %v", rows, expected)
+    }
+}
+
+func TestArrowTableSetRoundTrip(t *testing.T) {
+    empty := &Table{
+        ColumnNames : []string{"x"},
+        ColumnTypes : []ColumnDatatype{IntegerDatatype},
+    }
+    empty.initData()
+    people := &Table{
+        ColumnNames : []string{"name", "age"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, IntegerDatatype},
+    }
+    people.initData()
+    for _, row := range [][]interface{}{{"tim", 5}, {nil, 4}, {"lao", nil}} {
+        fatalOnError(people.writeRow(row), t)
+    }
+    tables := TableSet{
+        "people" : people,
+        "empty" : empty,
+    }
+    var buf bytes.Buffer
+    err := tables.ArrowWrite(&buf)
+    fatalOnError(err, t)
+
+    loaded, err := LoadTableSetFromArrow(&buf)
+    fatalOnError(err, t)
+    if len(loaded) != 2 || loaded["empty"] == nil {
+        t.Fatalf("loaded %v", loaded)
+    }
+    if loaded["empty"].rowCount() != 0 {
+        t.Error("empty table has rows")
+    }
+    rows, err := tableRows(loaded["people"])
+    fatalOnError(err, t)
+    if len(rows) != 3 || rows[2][0] != "lao" || rows[1][0] != nil || rows[2][1] != nil {
+        t.Errorf("people rows %v", rows)
+    }
+}
+
+func TestArrowMalformed(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"name", "height"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, FloatDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"tim", 1.1}, {"lao", 1.5}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    var buf bytes.Buffer
+    err := info.ArrowWrite(&buf)
+    fatalOnError(err, t)
+    data := buf.Bytes()
+
+    // truncated stream
+    _, err = LoadTableFromArrow(bytes.NewReader(data[:len(data) / 2]))
+    if err == nil {
+        t.Error("expected error for truncated stream")
+    }
+
+    // garbage offsets in schema message
+    corrupt := make([]byte, len(data))
+    copy(corrupt, data)
+    for i := 8; i < 24; i++ {
+        corrupt[i] = 0xff
+    }
+    _, err = LoadTableFromArrow(bytes.NewReader(corrupt))
+    if err == nil {
+        t.Error("expected error for corrupt schema")
+    }
+}
@@ -0,0 +1,162 @@
+package gemini
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// Return copy of datamart with the source table columns converted to the
+// datatypes given by SourceColumnProperty Cast, or d if nothing is cast.
+//
+// Strings are parsed as integers or floats, integers become floats, floats
+// become integers only if they are whole numbers and everything can become
+// a string. Values that don't convert are handled by CastFailure.
+func (d *Datamart) castSource() (*Datamart, error) {
+    src := d.SourceTableData
+    types := make([]ColumnDatatype, len(src.ColumnTypes))
+    copy(types, src.ColumnTypes)
+    policies := make([]string, len(types))
+    casts := false
+    for i, name := range src.ColumnNames {
+        prop, ok := d.SourceColumnProperties[name]
+        if !ok || prop.Cast == "" || prop.Cast == src.ColumnTypes[i] {
+            continue
+        }
+        if _, ok := mapDatatypeToSqlite[prop.Cast]; !ok {
+            return nil, fmt.Errorf(
+                "Datamart column %s unknown Cast datatype %s\n",
+                name,
+                prop.Cast,
+            )
+        }
+        switch prop.CastFailure {
+            case "":
+                policies[i] = CastError
+            case CastError, CastNull, CastKeep:
+                policies[i] = prop.CastFailure
+            default:
+                return nil, fmt.Errorf(
+                    "Datamart column %s unknown CastFailure %s\n",
+                    name,
+                    prop.CastFailure,
+                )
+        }
+        types[i] = prop.Cast
+        casts = true
+    }
+    if !casts {
+        return d, nil
+    }
+
+    row := make([]*interface{}, len(types))
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+    }
+
+    // first pass to find columns to keep as they are
+    for i := 0; i < src.rowCount(); i++ {
+        err := src.readRow(i, row)
+        if err != nil {
+            return nil, err
+        }
+        for j := 0; j < len(types); j++ {
+            if policies[j] != CastKeep || types[j] == src.ColumnTypes[j] {
+                continue
+            }
+            if _, ok := castValue(*row[j], types[j]); !ok {
+                types[j] = src.ColumnTypes[j]
+            }
+        }
+    }
+
+    cast := &Table{
+        ColumnNames: src.ColumnNames,
+        ColumnTypes: types,
+    }
+    cast.initData()
+    values := make([]interface{}, len(types))
+    for i := 0; i < src.rowCount(); i++ {
+        err := src.readRow(i, row)
+        if err != nil {
+            return nil, err
+        }
+        for j := 0; j < len(types); j++ {
+            if types[j] == src.ColumnTypes[j] {
+                values[j] = *row[j]
+                continue
+            }
+            value, ok := castValue(*row[j], types[j])
+            if !ok {
+                if policies[j] != CastNull {
+                    return nil, fmt.Errorf(
+                        "Datamart column %s row %d can't cast %v to %s\n",
+                        src.ColumnNames[j],
+                        i,
+                        *row[j],
+                        types[j],
+                    )
+                }
+                value = nil
+            }
+            values[j] = value
+        }
+        err = cast.writeRow(values)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    ret := *d
+    ret.SourceTableData = cast
+    return &ret, nil
+}
+
+// Convert int64, float64 or string value to datatype, false if it can't be
+func castValue(value interface{}, datatype ColumnDatatype) (interface{}, bool) {
+    if value == nil {
+        return nil, true
+    }
+    switch datatype {
+        case IntegerDatatype:
+            switch v := value.(type) {
+                case int64:
+                    return v, true
+                case float64:
+                    if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+                        return nil, false
+                    }
+                    return int64(v), true
+                case string:
+                    i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+                    if err != nil {
+                        return nil, false
+                    }
+                    return i, true
+            }
+        case FloatDatatype:
+            switch v := value.(type) {
+                case int64:
+                    return float64(v), true
+                case float64:
+                    return v, true
+                case string:
+                    f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+                    if err != nil {
+                        return nil, false
+                    }
+                    return f, true
+            }
+        case StringDatatype:
+            switch v := value.(type) {
+                case int64:
+                    return strconv.FormatInt(v, 10), true
+                case float64:
+                    return strconv.FormatFloat(v, 'g', -1, 64), true
+                case string:
+                    return v, true
+            }
+    }
+    return nil, false
+}
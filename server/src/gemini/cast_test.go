@@ -0,0 +1,102 @@
+package gemini
+
+import (
+    "testing"
+    "reflect"
+)
+
+var castPolicyTests = []struct {
+    failure string
+    datatype ColumnDatatype
+    values []interface{}
+}{
+    {CastNull, IntegerDatatype, []interface{}{int64(10), int64(2), nil, nil}},
+    {CastKeep, StringDatatype, []interface{}{"10", "2", "N1", nil}},
+}
+
+func TestCastSource(t *testing.T) {
+    source := &Table{
+        ColumnNames : []string{"route_short_name", "distance"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, FloatDatatype},
+    }
+    source.initData()
+    for _, row := range [][]interface{}{{"10", 2.0}, {"2", 3.5}, {"N1", 1.0}, {nil, 2.0}} {
+        fatalOnError(source.writeRow(row), t)
+    }
+    for _, test := range castPolicyTests {
+        d := &Datamart{
+            SourceTableData: source,
+            SourceColumnProperties: map[string]SourceColumnProperty{
+                "route_short_name": SourceColumnProperty{
+                    Cast: IntegerDatatype,
+                    CastFailure: test.failure,
+                },
+                "distance": SourceColumnProperty{
+                    Cast: StringDatatype,
+                },
+            },
+        }
+        cast, err := d.castSource()
+        fatalOnError(err, t)
+        info := cast.SourceTableData
+        if info.ColumnTypes[0] != test.datatype ||
+           info.ColumnTypes[1] != StringDatatype {
+            t.Errorf("%s: cast types %v", test.failure, info.ColumnTypes)
+        }
+        rows, err := tableRows(info)
+        fatalOnError(err, t)
+        for i, v := range test.values {
+            if !reflect.DeepEqual(rows[i][0], v) {
+                t.Errorf("%s: row %d value %#v expected %#v", test.failure, i, rows[i][0], v)
+            }
+        }
+        if rows[1][1] != "3.5" {
+            t.Errorf("%s: float cast to string %#v", test.failure, rows[1][1])
+        }
+        if d.SourceTableData.ColumnTypes[0] != StringDatatype {
+            t.Error("source table changed")
+        }
+    }
+
+    d := &Datamart{
+        SourceTableData: source,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "route_short_name": SourceColumnProperty{Cast: IntegerDatatype},
+        },
+    }
+    _, err := d.castSource()
+    if err == nil {
+        t.Error("expected error casting N1 to integer")
+    }
+}
+
+func TestPerformQueriesCast(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route_short_name"},
+        ColumnTypes : []ColumnDatatype{StringDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"10"}, {"2"}, {"N1"}, {nil}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "route_short_name": SourceColumnProperty{
+                Cast: IntegerDatatype,
+                CastFailure: CastNull,
+            },
+        },
+    }
+    tables, err := d.PerformQueries()
+    fatalOnError(err, t)
+    dim := tables["route_short_names"]
+    if dim.ColumnTypes[1] != IntegerDatatype {
+        t.Errorf("dimension type %s", dim.ColumnTypes[1])
+    }
+    rows, err := tableRows(dim)
+    fatalOnError(err, t)
+    if len(rows) != 2 || rows[0][1] != int64(2) || rows[1][1] != int64(10) {
+        t.Errorf("dimension rows %v, expected numeric order", rows)
+    }
+}
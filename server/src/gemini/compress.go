@@ -0,0 +1,152 @@
+package gemini
+
+import (
+    "compress/gzip"
+    "compress/zlib"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// Content encodings, named as in HTTP Content-Encoding. DeflateEncoding is
+// deflate in the zlib format, which is what HTTP calls deflate.
+const (
+    GzipEncoding string = "gzip"
+    DeflateEncoding string = "deflate"
+    IdentityEncoding string = "identity"
+)
+
+type compressor interface {
+    io.WriteCloser
+    Flush() error
+}
+
+// Compresses writes to w, flushing compresses all data written so far and
+// flushes w so the output can be streamed
+type CompressWriter struct {
+    w io.Writer
+    c compressor
+}
+
+// Return writer compressing to w with encoding at level, eg.
+// gzip.BestSpeed or gzip.DefaultCompression. Close must be called to
+// finish the compressed stream, it does not close w.
+func NewCompressWriter(w io.Writer, encoding string,
+                       level int) (*CompressWriter, error) {
+    var c compressor
+    var err error
+    switch encoding {
+        case GzipEncoding:
+            c, err = gzip.NewWriterLevel(w, level)
+        case DeflateEncoding:
+            c, err = zlib.NewWriterLevel(w, level)
+        case IdentityEncoding:
+        default:
+            return nil, fmt.Errorf("NewCompressWriter() error, unknown encoding %s\n", encoding)
+    }
+    if err != nil {
+        // invalid level
+        return nil, fmt.Errorf("NewCompressWriter() error, %s\n", err.Error())
+    }
+    return &CompressWriter{w, c}, nil
+}
+
+func (c *CompressWriter) Write(p []byte) (int, error) {
+    if c.c == nil {
+        return c.w.Write(p)
+    }
+    return c.c.Write(p)
+}
+
+func (c *CompressWriter) Flush() error {
+    if c.c != nil {
+        err := c.c.Flush()
+        if err != nil {
+            return err
+        }
+    }
+    return flushWriter(c.w)
+}
+
+func (c *CompressWriter) Close() error {
+    if c.c == nil {
+        return nil
+    }
+    return c.c.Close()
+}
+
+// Call write, eg. a TableSet's JSONWrite, with a writer compressing to w
+func CompressWrite(w io.Writer, encoding string, level int,
+                   write func(w io.Writer) error) error {
+    c, err := NewCompressWriter(w, encoding, level)
+    if err != nil {
+        return err
+    }
+    err = write(c)
+    if err != nil {
+        return err
+    }
+    return c.Close()
+}
+
+// Choose encoding for an Accept-Encoding header value, the supported
+// encoding with the highest quality, gzip over deflate if equal.
+// IdentityEncoding if neither is accepted.
+func SelectEncoding(acceptEncoding string) string {
+    quality := map[string]float64{}
+    wildcard := -1.0
+    for _, part := range strings.Split(acceptEncoding, ",") {
+        fields := strings.Split(part, ";")
+        coding := strings.ToLower(strings.TrimSpace(fields[0]))
+        if coding == "" {
+            continue
+        }
+        q := 1.0
+        for _, param := range fields[1:] {
+            param = strings.TrimSpace(param)
+            if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+                v, err := strconv.ParseFloat(param[2:], 64)
+                if err != nil {
+                    v = 0
+                }
+                q = v
+            }
+        }
+        if coding == "x-gzip" {
+            coding = GzipEncoding
+        }
+        if coding == "*" {
+            wildcard = q
+        } else {
+            quality[coding] = q
+        }
+    }
+
+    best := IdentityEncoding
+    bestQ := 0.0
+    for _, encoding := range []string{GzipEncoding, DeflateEncoding} {
+        q, ok := quality[encoding]
+        if !ok {
+            q = wildcard
+        }
+        if q > bestQ {
+            best, bestQ = encoding, q
+        }
+    }
+    return best
+}
+
+// Write response body with write, compressed at level with the encoding
+// chosen from the request's Accept-Encoding. Sets Content-Encoding, so
+// call before writing anything else to the response.
+func HTTPWrite(w http.ResponseWriter, r *http.Request, level int,
+               write func(w io.Writer) error) error {
+    encoding := SelectEncoding(r.Header.Get("Accept-Encoding"))
+    w.Header().Add("Vary", "Accept-Encoding")
+    if encoding != IdentityEncoding {
+        w.Header().Set("Content-Encoding", encoding)
+    }
+    return CompressWrite(w, encoding, level, write)
+}
@@ -0,0 +1,165 @@
+package gemini
+
+import (
+    "bytes"
+    "compress/gzip"
+    "compress/zlib"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func decompress(encoding string, data []byte, t *testing.T) []byte {
+    var r io.Reader = bytes.NewReader(data)
+    var err error
+    switch encoding {
+        case GzipEncoding:
+            r, err = gzip.NewReader(r)
+        case DeflateEncoding:
+            r, err = zlib.NewReader(r)
+    }
+    fatalOnError(err, t)
+    out, err := ioutil.ReadAll(r)
+    fatalOnError(err, t)
+    return out
+}
+
+func TestCompressWrite(t *testing.T) {
+    stops := &Table{
+        ColumnNames : []string{"stop_name", "arrivals"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, IntegerDatatype},
+    }
+    stops.initData()
+    for _, row := range [][]interface{}{
+        {"Courtenay Place", 120},
+        {"Courtenay Place", 95},
+        {"Kilbirnie", nil},
+        {nil, 3},
+    } {
+        fatalOnError(stops.writeRow(row), t)
+    }
+    tables := TableSet{"stops" : stops}
+    var plain bytes.Buffer
+    fatalOnError(tables.JSONWrite(&plain), t)
+
+    for _, encoding := range []string{GzipEncoding, DeflateEncoding, IdentityEncoding} {
+        for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+            var buf bytes.Buffer
+            err := CompressWrite(&buf, encoding, level, tables.JSONWrite)
+            fatalOnError(err, t)
+            out := decompress(encoding, buf.Bytes(), t)
+            if !bytes.Equal(out, plain.Bytes()) {
+                t.Errorf("%s %d: got %s", encoding, level, out)
+            }
+        }
+    }
+
+    var buf bytes.Buffer
+    if CompressWrite(&buf, "br", gzip.BestSpeed, tables.JSONWrite) == nil {
+        t.Error("expected error for unknown encoding")
+    }
+    if CompressWrite(&buf, GzipEncoding, 42, tables.JSONWrite) == nil {
+        t.Error("expected error for bad level")
+    }
+    if CompressWrite(&failingWriter{limit : 10}, GzipEncoding, 9, tables.JSONWrite) == nil {
+        t.Error("expected write error")
+    }
+}
+
+func TestCompressWriterFlush(t *testing.T) {
+    // NDJSON flushes as it goes, each flush must reach the writer
+    stops := &Table{
+        ColumnNames : []string{"stop_name", "arrivals"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, IntegerDatatype},
+    }
+    stops.initData()
+    for _, row := range [][]interface{}{
+        {"Courtenay Place", 120},
+        {"Courtenay Place", 95},
+        {"Kilbirnie", nil},
+        {nil, 3},
+    } {
+        fatalOnError(stops.writeRow(row), t)
+    }
+    var w countingFlushWriter
+    err := CompressWrite(&w, GzipEncoding, gzip.DefaultCompression, stops.NDJSONWrite)
+    fatalOnError(err, t)
+    if w.flushes == 0 {
+        t.Error("underlying writer not flushed")
+    }
+    out := decompress(GzipEncoding, w.Bytes(), t)
+    if !bytes.HasPrefix(out, []byte(`{"ColumnNames":["stop_name","arrivals"]`)) {
+        t.Errorf("decompressed %s", out)
+    }
+}
+
+var selectEncodingTests = []struct {
+    accept string
+    encoding string
+}{
+    {"", IdentityEncoding},
+    {"gzip, deflate", GzipEncoding},
+    {"deflate, gzip", GzipEncoding},
+    {"deflate", DeflateEncoding},
+    {"gzip;q=0.5, deflate", DeflateEncoding},
+    {"GZIP;Q=0.8, deflate;q=0.2", GzipEncoding},
+    {"gzip;q=0, deflate;q=0", IdentityEncoding},
+    {"br, *", GzipEncoding},
+    {"*;q=0, deflate;q=0.1", DeflateEncoding},
+    {"x-gzip", GzipEncoding},
+    {"br, identity", IdentityEncoding},
+}
+
+func TestSelectEncoding(t *testing.T) {
+    for _, test := range selectEncodingTests {
+        encoding := SelectEncoding(test.accept)
+        if encoding != test.encoding {
+            t.Errorf("%q: got %s expected %s", test.accept, encoding, test.encoding)
+        }
+    }
+}
+
+func TestHTTPWrite(t *testing.T) {
+    stops := &Table{
+        ColumnNames : []string{"stop_name", "arrivals"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, IntegerDatatype},
+    }
+    stops.initData()
+    for _, row := range [][]interface{}{
+        {"Courtenay Place", 120},
+        {"Courtenay Place", 95},
+        {"Kilbirnie", nil},
+        {nil, 3},
+    } {
+        fatalOnError(stops.writeRow(row), t)
+    }
+    tables := TableSet{"stops" : stops}
+    var plain bytes.Buffer
+    fatalOnError(tables.JSONWrite(&plain), t)
+
+    for _, test := range selectEncodingTests[:5] {
+        r, err := http.NewRequest("GET", "/tables", nil)
+        fatalOnError(err, t)
+        if test.accept != "" {
+            r.Header.Set("Accept-Encoding", test.accept)
+        }
+        w := httptest.NewRecorder()
+        err = HTTPWrite(w, r, gzip.BestSpeed, tables.JSONWrite)
+        fatalOnError(err, t)
+
+        contentEncoding := w.Header().Get("Content-Encoding")
+        if test.encoding == IdentityEncoding && contentEncoding != "" ||
+           test.encoding != IdentityEncoding && contentEncoding != test.encoding {
+            t.Errorf("%q: Content-Encoding %q", test.accept, contentEncoding)
+        }
+        if w.Header().Get("Vary") != "Accept-Encoding" {
+            t.Errorf("%q: Vary %q", test.accept, w.Header().Get("Vary"))
+        }
+        out := decompress(test.encoding, w.Body.Bytes(), t)
+        if !bytes.Equal(out, plain.Bytes()) {
+            t.Errorf("%q: body %s", test.accept, out)
+        }
+    }
+}
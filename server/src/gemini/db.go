@@ -0,0 +1,260 @@
+package gemini
+
+import (
+    "fmt"
+    "reflect"
+    "sort"
+    "strings"
+)
+
+// Go side of the JS client's GeminiDb, for services reading a TableSet
+// (for example one loaded with LoadTableSetFromJSON) without the client.
+// Fact rows are resolved to maps of dimension column name to value. A fact
+// column with a NULL (-1) id has the fact column set to -1 and none of its
+// dimension's columns. Measure columns keep their fact table value.
+type Db struct {
+    Tables TableSet
+    columns []FactColumn
+    joiner *factJoiner
+}
+
+func NewDb(tables TableSet) (*Db, error) {
+    if _, ok := tables["fact"]; !ok {
+        return nil, fmt.Errorf("NewDb() error, can't find fact table\n")
+    }
+    columns, err := tables.FactColumns()
+    if err != nil {
+        return nil, err
+    }
+    joiner, err := tables.newFactJoiner(columns)
+    if err != nil {
+        return nil, fmt.Errorf("NewDb() error, %s\n", err.Error())
+    }
+    return &Db{Tables : tables, columns : columns, joiner : joiner}, nil
+}
+
+// number of fact rows
+func (db *Db) FactCount() int {
+    return db.Tables["fact"].rowCount()
+}
+
+// Fact row joined to its dimension rows, as GeminiDb.factLookup
+func (db *Db) FactLookup(row int) (map[string]interface{}, error) {
+    if row < 0 || row >= db.FactCount() {
+        return nil, fmt.Errorf("FactLookup() error, no fact row %d\n", row)
+    }
+    fact := db.Tables["fact"]
+    values := make([]*interface{}, len(fact.ColumnNames))
+    for i := 0; i < len(values); i++ {
+        values[i] = new(interface{})
+    }
+    err := fact.readRow(row, values)
+    if err != nil {
+        return nil, err
+    }
+    return db.joiner.join(values), nil
+}
+
+// Map of fact column name to id joined to the dimension rows, as
+// GeminiDb.joinFactToDim. Ids may be any integer type or integral floats
+// (as numbers decoded from JSON are).
+func (db *Db) JoinFactToDim(factRow map[string]interface{}) (map[string]interface{}, error) {
+    joined := make(map[string]interface{})
+    for column, v := range factRow {
+        i := db.factColumnIndex(column)
+        if i == -1 {
+            return nil, fmt.Errorf("JoinFactToDim() error, unknown fact column %s\n", column)
+        }
+        if db.columns[i].Measure {
+            joined[column] = v
+            continue
+        }
+        id, ok := toInt64(v)
+        if !ok || id < -1 || id >= int64(len(db.joiner.dims[i])) {
+            return nil, fmt.Errorf("JoinFactToDim() error, bad %s id %v\n", column, v)
+        }
+        if id == -1 {
+            joined[column] = int64(-1)
+            continue
+        }
+        for k, name := range db.joiner.dimNames[i] {
+            joined[name] = db.joiner.dims[i][id][k]
+        }
+    }
+    return joined, nil
+}
+
+func (db *Db) factColumnIndex(column string) int {
+    for i, c := range db.columns {
+        if c.Column == column {
+            return i
+        }
+    }
+    return -1
+}
+
+func toInt64(v interface{}) (int64, bool) {
+    switch v := v.(type) {
+        case int:
+            return int64(v), true
+        case int32:
+            return int64(v), true
+        case int64:
+            return v, true
+        case float64:
+            if v == float64(int64(v)) {
+                return int64(v), true
+            }
+    }
+    return 0, false
+}
+
+// Fact row joined to its dimension rows stored in the struct pointed to by
+// v, see RowToStruct
+func (db *Db) FactLookupStruct(row int, v interface{}) error {
+    joined, err := db.FactLookup(row)
+    if err != nil {
+        return err
+    }
+    return RowToStruct(joined, v)
+}
+
+// Distinct dimension rows of the tables for fact rows passing filter (all
+// if nil), as GeminiQuery.simplesort. Rows are sorted by the tables' ids
+// in order, NULL first, and each joins only the given tables.
+func (db *Db) SimpleSort(tables []string, filter RowFilter) ([]map[string]interface{}, error) {
+    keys, err := db.Tables.selectKeys(tables, filter)
+    if err != nil {
+        return nil, err
+    }
+    sort.Sort(keyOrder(keys))
+
+    factColumns := make([]string, len(tables))
+    for i, name := range tables {
+        for _, c := range db.columns {
+            if c.Dimension == name {
+                factColumns[i] = c.Column
+            }
+        }
+    }
+    results := make([]map[string]interface{}, len(keys))
+    for i, key := range keys {
+        factRow := make(map[string]interface{})
+        for j, id := range key {
+            factRow[factColumns[j]] = id
+        }
+        results[i], err = db.JoinFactToDim(factRow)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return results, nil
+}
+
+type keyOrder [][]int64
+
+func (o keyOrder) Len() int {
+    return len(o)
+}
+
+func (o keyOrder) Less(i, j int) bool {
+    for k := range o[i] {
+        if o[i][k] != o[j][k] {
+            return o[i][k] < o[j][k]
+        }
+    }
+    return false
+}
+
+func (o keyOrder) Swap(i, j int) {
+    o[i], o[j] = o[j], o[i]
+}
+
+// Store row in the struct pointed to by v. Each exported field takes the
+// column named by its `gemini:"column"` tag, or otherwise the column
+// matching its name ignoring case; fields tagged "-" are skipped. Fields
+// may be integers, floats, strings, pointers to these or interface{}.
+// NULL values and columns not in row, as for the dimension columns of a
+// NULL id, set fields to their zero value (nil pointers).
+func RowToStruct(row map[string]interface{}, v interface{}) error {
+    rv := reflect.ValueOf(v)
+    if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+        return fmt.Errorf("RowToStruct() error, needs pointer to struct, got %T\n", v)
+    }
+    rv = rv.Elem()
+    rt := rv.Type()
+    for i := 0; i < rt.NumField(); i++ {
+        field := rt.Field(i)
+        if field.PkgPath != "" {
+            continue
+        }
+        name := field.Tag.Get("gemini")
+        if name == "-" {
+            continue
+        }
+        var value interface{}
+        if name != "" {
+            value = row[name]
+        } else {
+            name = field.Name
+            for column, columnValue := range row {
+                if strings.EqualFold(column, field.Name) {
+                    value = columnValue
+                }
+            }
+        }
+        err := setField(rv.Field(i), value)
+        if err != nil {
+            return fmt.Errorf("RowToStruct() error, field %s column %s: %s\n",
+                              field.Name,
+                              name,
+                              err.Error())
+        }
+    }
+    return nil
+}
+
+func setField(f reflect.Value, value interface{}) error {
+    if value == nil {
+        f.Set(reflect.Zero(f.Type()))
+        return nil
+    }
+    switch f.Kind() {
+        case reflect.Interface:
+            if f.NumMethod() != 0 {
+                break
+            }
+            f.Set(reflect.ValueOf(value))
+            return nil
+        case reflect.Ptr:
+            p := reflect.New(f.Type().Elem())
+            err := setField(p.Elem(), value)
+            if err != nil {
+                return err
+            }
+            f.Set(p)
+            return nil
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+            i, ok := toInt64(value)
+            if !ok || f.OverflowInt(i) {
+                break
+            }
+            f.SetInt(i)
+            return nil
+        case reflect.Float32, reflect.Float64:
+            switch value := value.(type) {
+                case float64:
+                    f.SetFloat(value)
+                    return nil
+                case int64:
+                    f.SetFloat(float64(value))
+                    return nil
+            }
+        case reflect.String:
+            if s, ok := value.(string); ok {
+                f.SetString(s)
+                return nil
+            }
+    }
+    return fmt.Errorf("can't store %T in %s", value, f.Type())
+}
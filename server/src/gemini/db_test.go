@@ -0,0 +1,185 @@
+package gemini
+
+import (
+    "bytes"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// star schema of people's names and ages as JSONWrite writes it
+const dbTestTables = `{
+"ages":{"ColumnNames":["age_id","age"], "ColumnTypes":["integer","integer"],
+    "Data":[[0,35],[1,40]]},
+"fact":{"ColumnNames":["name_id","age_id"], "ColumnTypes":["integer","integer"],
+    "Data":[[1,-1],[0,1],[0,0],[1,-1],[-1,0]]},
+"names":{"ColumnNames":["name_id","name"], "ColumnTypes":["integer","string"],
+    "Data":[[0,"tim"],[1,"scarlet"]]}
+}`
+
+func TestDbFactLookup(t *testing.T) {
+    tables, err := LoadTableSetFromJSON(strings.NewReader(dbTestTables))
+    fatalOnError(err, t)
+    db, err := NewDb(tables)
+    fatalOnError(err, t)
+    if db.FactCount() != 5 {
+        t.Errorf("fact count %d", db.FactCount())
+    }
+
+    // as GeminiDb.factLookup
+    expected := []map[string]interface{}{
+        {"name_id" : int64(1), "name" : "scarlet", "age_id" : int64(-1)},
+        {"name_id" : int64(0), "name" : "tim", "age_id" : int64(1), "age" : int64(40)},
+        {"name_id" : int64(0), "name" : "tim", "age_id" : int64(0), "age" : int64(35)},
+        {"name_id" : int64(1), "name" : "scarlet", "age_id" : int64(-1)},
+        {"name_id" : int64(-1), "age_id" : int64(0), "age" : int64(35)},
+    }
+    for i, row := range expected {
+        joined, err := db.FactLookup(i)
+        fatalOnError(err, t)
+        if !reflect.DeepEqual(joined, row) {
+            t.Errorf("row %d: got %v expected %v", i, joined, row)
+        }
+    }
+    if _, err = db.FactLookup(5); err == nil {
+        t.Error("expected error for missing row")
+    }
+
+    joined, err := db.JoinFactToDim(map[string]interface{}{"age_id" : float64(1)})
+    fatalOnError(err, t)
+    if !reflect.DeepEqual(joined, map[string]interface{}{"age_id" : int64(1), "age" : int64(40)}) {
+        t.Errorf("JoinFactToDim got %v", joined)
+    }
+    for _, bad := range []map[string]interface{}{{"x_id" : 0}, {"age_id" : 2}, {"age_id" : 0.5}} {
+        if _, err = db.JoinFactToDim(bad); err == nil {
+            t.Errorf("expected error for %v", bad)
+        }
+    }
+}
+
+type person struct {
+    Name *string
+    Years int `gemini:"age"`
+    Id interface{} `gemini:"name_id"`
+    AgeId int16 `gemini:"age_id"`
+    Skip string `gemini:"-"`
+}
+
+func TestDbFactLookupStruct(t *testing.T) {
+    tables, err := LoadTableSetFromJSON(strings.NewReader(dbTestTables))
+    fatalOnError(err, t)
+    db, err := NewDb(tables)
+    fatalOnError(err, t)
+
+    p := person{Years : 99, Skip : "x"}
+    fatalOnError(db.FactLookupStruct(1, &p), t)
+    if p.Name == nil || *p.Name != "tim" || p.Years != 40 || p.Id != int64(0) ||
+       p.AgeId != 1 || p.Skip != "x" {
+        t.Errorf("row 1 got %+v", p)
+    }
+    fatalOnError(db.FactLookupStruct(4, &p), t)
+    if p.Name != nil || p.Years != 35 || p.Id != int64(-1) || p.AgeId != 0 {
+        t.Errorf("row 4 got %+v", p)
+    }
+
+    if db.FactLookupStruct(0, p) == nil {
+        t.Error("expected error for non pointer")
+    }
+    var wrong struct {
+        Name int
+    }
+    if db.FactLookupStruct(0, &wrong) == nil {
+        t.Error("expected error for wrong field type")
+    }
+}
+
+func TestDbSimpleSort(t *testing.T) {
+    tables, err := LoadTableSetFromJSON(strings.NewReader(dbTestTables))
+    fatalOnError(err, t)
+    db, err := NewDb(tables)
+    fatalOnError(err, t)
+
+    // as GeminiQuery.simplesort
+    rows, err := db.SimpleSort([]string{"ages", "names"}, nil)
+    fatalOnError(err, t)
+    expected := []map[string]interface{}{
+        {"age_id" : int64(-1), "name_id" : int64(1), "name" : "scarlet"},
+        {"age_id" : int64(0), "age" : int64(35), "name_id" : int64(-1)},
+        {"age_id" : int64(0), "age" : int64(35), "name_id" : int64(0), "name" : "tim"},
+        {"age_id" : int64(1), "age" : int64(40), "name_id" : int64(0), "name" : "tim"},
+    }
+    if !reflect.DeepEqual(rows, expected) {
+        t.Errorf("got %v expected %v", rows, expected)
+    }
+
+    rows, err = db.SimpleSort([]string{"names"}, func(row map[string]interface{}) bool {
+        return row["age"] != int64(35)
+    })
+    fatalOnError(err, t)
+    expected = []map[string]interface{}{
+        {"name_id" : int64(0), "name" : "tim"},
+        {"name_id" : int64(1), "name" : "scarlet"},
+    }
+    if !reflect.DeepEqual(rows, expected) {
+        t.Errorf("filtered got %v expected %v", rows, expected)
+    }
+
+    if _, err = db.SimpleSort([]string{"heights"}, nil); err == nil {
+        t.Error("expected error for unknown table")
+    }
+}
+
+func TestDbFromJSON(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route_short_name", "distance"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, FloatDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"10", 2.0}, {"2", 3.5}, {"N1", 1.0}, {nil, 2.0}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "distance" : SourceColumnProperty{PartOfDim: "route_short_names"},
+        },
+    }
+    tables, err := d.PerformQueries()
+    fatalOnError(err, t)
+    for _, format := range []string{JSONRows, JSONColumns} {
+        var buf bytes.Buffer
+        fatalOnError(tables.JSONWriteOptions(&buf, JSONOptions{Format : format}), t)
+        loaded, err := LoadTableSetFromJSON(&buf)
+        fatalOnError(err, t)
+        for name, table := range tables {
+            expected, err := tableRows(table)
+            fatalOnError(err, t)
+            rows, err := tableRows(loaded[name])
+            fatalOnError(err, t)
+            if !reflect.DeepEqual(rows, expected) ||
+               !reflect.DeepEqual(loaded[name].ColumnTypes, table.ColumnTypes) {
+                t.Errorf("%s %s: got %v expected %v", format, name, rows, expected)
+            }
+        }
+
+        db, err := NewDb(loaded)
+        fatalOnError(err, t)
+        rows, err := db.SimpleSort([]string{"route_short_names"}, nil)
+        fatalOnError(err, t)
+        if len(rows) != 4 || rows[0]["route_short_name_id"] != int64(-1) ||
+           rows[3]["route_short_name"] != "N1" {
+            t.Errorf("%s: simple sort got %v", format, rows)
+        }
+    }
+
+    for _, bad := range []string{
+        `{"fact":null}`,
+        `{"fact":{"ColumnNames":["a"],"ColumnTypes":["blob"],"Data":[]}}`,
+        `{"fact":{"ColumnNames":["a"],"ColumnTypes":["integer"],"Data":[["x"]]}}`,
+        `{"fact":{"ColumnNames":["a"],"ColumnTypes":["integer"],"Data":[[1,2]]}}`,
+    } {
+        if _, err = LoadTableSetFromJSON(bytes.NewBufferString(bad)); err == nil {
+            t.Errorf("expected error for %s", bad)
+        }
+    }
+}
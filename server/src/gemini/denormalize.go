@@ -9,9 +9,21 @@ which index it. Meant for creating data driven user displays.
 * Except if column name is in SourceColumnProperties map and is asigned to an 
   another dimension table using PartOfDim.
 * The order of the dimension tables can be assigned in SourceColumnProperty
+  using Order, dimensions without an Order follow in source column order
+* A date/time source column can have a time dimension, with year, month,
+  hour etc. columns, using Time
+* A source column can be converted to another datatype using Cast, with
+  CastFailure saying what happens to values that don't convert
 * The fact table only contains dimension table row ids, tying the dimension 
   tables together.
-* Uses Sqlite to do table manipulation
+* Except columns with Measure set in SourceColumnProperty, these have no
+  dimension table, their values are kept in the fact table after the ids
+* A meta table describes which dimension table each fact column refers to,
+  see MetaTable
+* With Aggregation set the fact table has a row per combination of some of
+  the dimensions, with aggregates of the measure columns
+* Uses Sqlite to do table manipulation, or with Engine set to GoEngine
+  builds the same tables in Go without Sqlite
 
 example definiton:
 
@@ -22,10 +34,12 @@ d := gemini.Datamart{
             PartOfDim: "stop_ids",
         },
         "route_short_name" : gemini.SourceColumnProperty{
-            SortExpr: "convert(route_short_name, signed)",
+            Cast: gemini.IntegerDatatype,
+            CastFailure: gemini.CastNull,
         },
         "destination_distance" : gemini.SourceColumnProperty{
             SortDirection: "desc",
+            Order: 1,
         },
     },
 }
@@ -34,7 +48,9 @@ package gemini
 
 import (
     "fmt"
+    "sort"
     "sqlite"
+    "strconv"
     "strings"
 )
 
@@ -46,20 +62,93 @@ const (
 type Datamart struct {
     SourceTableData *Table
     SourceColumnProperties map[string]SourceColumnProperty
+    // how PerformQueries builds the tables, SqliteEngine if not set
+    Engine string
+    // if set the fact table is grouped by some of the dimensions
+    Aggregation *Aggregation
 }
 
+// Datamart Engine values
+const (
+    // tables are built with queries on an in memory Sqlite database
+    SqliteEngine string = "sqlite"
+    // tables are built in Go with maps and sorting, giving the same
+    // TableSet as SqliteEngine. SortExpr must be a source column name.
+    GoEngine string = "go"
+)
+
 type SourceColumnProperty struct {
+    // sqlite expression over source columns, names in it must be quoted
+    // if they are keywords or not plain identifiers, eg. "order" * 2
     SortExpr string
     SortDirection string    
     PartOfDim string
+    // position of the column's dimension in the fact table and TableSet
+    // output, lowest first. 0 is unset, these dimensions come after those
+    // with an Order, in source column order. Negative is an error
+    Order int
+    // convert source column to this datatype before building dimensions
+    Cast ColumnDatatype
+    // what to do with a value that can't be cast, CastError if not set
+    CastFailure string
+    // keep the column's values in the fact table instead of making a
+    // dimension, PartOfDim and the other dimension options are ignored
+    Measure bool
+    // make the column's dimension a time dimension, not with Measure or
+    // PartOfDim
+    Time *TimeDimension
 }
 
+// SourceColumnProperty CastFailure policies
+const (
+    // PerformQueries returns an error
+    CastError string = "error"
+    // value becomes NULL
+    CastNull string = "null"
+    // column is not cast, keeping its source values and datatype
+    CastKeep string = "keep"
+)
+
 type DimensionDefinition struct {
     IndexColumn string
     UniqueColumn string
     ExtraColumns []string
     SortExpr string
     SortDirection string
+    // dimensions are created and their columns placed in the fact table
+    // in order of Position, then name
+    Position int
+}
+
+type dimOrder struct {
+    names []string
+    dimDefs map[string]*DimensionDefinition
+}
+
+func (o dimOrder) Len() int {
+    return len(o.names)
+}
+
+func (o dimOrder) Less(i, j int) bool {
+    a, b := o.dimDefs[o.names[i]], o.dimDefs[o.names[j]]
+    if a.Position != b.Position {
+        return a.Position < b.Position
+    }
+    return o.names[i] < o.names[j]
+}
+
+func (o dimOrder) Swap(i, j int) {
+    o.names[i], o.names[j] = o.names[j], o.names[i]
+}
+
+// Dimension names in Position order
+func orderedDimNames(dimDefs map[string]*DimensionDefinition) []string {
+    o := dimOrder{make([]string, 0, len(dimDefs)), dimDefs}
+    for name := range dimDefs {
+        o.names = append(o.names, name)
+    }
+    sort.Sort(o)
+    return o.names
 }
 
 func (d *Datamart) findDatatype(column string) string {
@@ -71,22 +160,93 @@ func (d *Datamart) findDatatype(column string) string {
     return ""
 }
 
+// Check SourceColumnProperties options SetupDimDefinitions can't report
+func (d *Datamart) checkColumnProperties() error {
+    for name, prop := range d.SourceColumnProperties {
+        if prop.Order < 0 {
+            return fmt.Errorf("PerformQueries() error, negative Order %d for %s\n",
+                              prop.Order,
+                              name)
+        }
+    }
+    // fact table columns are the dimensions' IndexColumns then the measures
+    dimDefs := d.SetupDimDefinitions()
+    for _, measure := range d.measureColumns() {
+        for _, name := range orderedDimNames(dimDefs) {
+            if dimDefs[name].IndexColumn == measure {
+                return fmt.Errorf("PerformQueries() error, measure %s is the %s IndexColumn\n",
+                                  measure,
+                                  name)
+            }
+        }
+    }
+    // time columns are only made for a column's own dimension, named after
+    // the column
+    for _, name := range d.SourceTableData.ColumnNames {
+        prop := d.SourceColumnProperties[name]
+        if prop.Time == nil {
+            continue
+        }
+        if prop.Measure || prop.PartOfDim != "" {
+            return fmt.Errorf("PerformQueries() error, Time set for %s with Measure or PartOfDim\n",
+                              name)
+        }
+        for _, suffix := range timeColumnSuffixes {
+            if d.SourceTableData.columnIndex(name + suffix) != -1 {
+                return fmt.Errorf("PerformQueries() error, time column %s of %s is a source column\n",
+                                  name + suffix,
+                                  name)
+            }
+        }
+    }
+    return nil
+}
+
+// Source columns with Measure set, in source column order
+func (d *Datamart) measureColumns() []string {
+    var measures []string
+    for _, name := range d.SourceTableData.ColumnNames {
+        if d.SourceColumnProperties[name].Measure {
+            measures = append(measures, name)
+        }
+    }
+    return measures
+}
+
 // Return map of dimension name to DimDefinition 
 func (d *Datamart) SetupDimDefinitions() map[string]*DimensionDefinition {
     dimDefs := make(map[string]*DimensionDefinition)
 
+    // dimensions are positioned by Order then source column order, columns
+    // without an Order go after the highest Order
+    n := len(d.SourceTableData.ColumnNames)
+    unordered := 1
+    for _, prop := range d.SourceColumnProperties {
+        if prop.Order >= unordered {
+            unordered = prop.Order + 1
+        }
+    }
+
     // populate dimDefs using column names in SourceTableData.ColumnNames 
     // and any options in SourceColumnProperties
-    for _, name := range d.SourceTableData.ColumnNames  {
+    for i, name := range d.SourceTableData.ColumnNames  {
         prop, ok := d.SourceColumnProperties[name]
+        if prop.Measure {
+            continue
+        }
         if !ok || prop.PartOfDim == "" {
             dim := new(DimensionDefinition)
+            if prop.Order > 0 {
+                dim.Position = prop.Order * n + i
+            } else {
+                dim.Position = unordered * n + i
+            }
             dim.IndexColumn = name + "_id"
             dim.UniqueColumn = name
             if  ok && prop.SortExpr != "" {
                 dim.SortExpr = prop.SortExpr
             } else {
-                dim.SortExpr = dim.UniqueColumn
+                dim.SortExpr = quoteIdentifier(dim.UniqueColumn)
             }
             if ok && prop.SortDirection != "" {
                 dim.SortDirection = prop.SortDirection
@@ -97,15 +257,13 @@ func (d *Datamart) SetupDimDefinitions() map[string]*DimensionDefinition {
         } 
     }
 
-    // add any source columns properties with PartOfDim set to the correct dim
-    for name, prop := range d.SourceColumnProperties {
-        if prop.PartOfDim != "" {
+    // add any source columns properties with PartOfDim set to the correct
+    // dim, in source column order
+    for _, name := range d.SourceTableData.ColumnNames {
+        prop := d.SourceColumnProperties[name]
+        if prop.PartOfDim != "" && !prop.Measure {
             if v, ok := dimDefs[prop.PartOfDim]; ok {
-                for _, colName := range d.SourceTableData.ColumnNames {
-                    if colName == name {
-                        v.ExtraColumns = append(v.ExtraColumns, name)
-                    }
-                }
+                v.ExtraColumns = append(v.ExtraColumns, name)
             }
         }
     }
@@ -118,22 +276,51 @@ func (d *Datamart) CreateDimensionTables(dimDefs map[string]*DimensionDefinition
                                          conn *sqlite.Conn) error {
     var queryStr string
     var err error
-    for name, dim := range dimDefs {
+    for _, name := range orderedDimNames(dimDefs) {
+        dim := dimDefs[name]
+        // sort direction is spliced into the query so only allow asc, desc
+        direction := strings.ToLower(dim.SortDirection)
+        if direction != Asc && direction != Desc {
+            return fmt.Errorf(
+                "CreateDimensionTables() error, bad sort direction %q for %s\n",
+                dim.SortDirection,
+                name,
+            )
+        }
+        // source table is created by PerformQueries
+        if strings.ToLower(name) == "source" {
+            return fmt.Errorf(
+                "CreateDimensionTables() error, dimension name %s is reserved\n",
+                name,
+            )
+        }
+
         // "integer primary key" creates as auto incrementing column
         queryStr = fmt.Sprintf(
             "create table %s (%s integer primary key, %s %s",
-            name,
-            dim.IndexColumn,
-            dim.UniqueColumn,
+            quoteIdentifier(name),
+            quoteIdentifier(dim.IndexColumn),
+            quoteIdentifier(dim.UniqueColumn),
             d.findDatatype(dim.UniqueColumn),
         )
         extraStr := ""
         for _, extra := range dim.ExtraColumns {
-            queryStr += fmt.Sprintf(", %s %s", extra, d.findDatatype(extra))
-            extraStr += "," + extra
+            queryStr += fmt.Sprintf(
+                ", %s %s",
+                quoteIdentifier(extra),
+                d.findDatatype(extra),
+            )
+            extraStr += "," + quoteIdentifier(extra)
         }
         queryStr += "); "
 
+        // alias for sort expression must not be a source column name
+        // otherwise group by uses the source column
+        sortAlias := "sort"
+        for d.isSourceColumn(sortAlias) {
+            sortAlias += "_"
+        }
+
         err = conn.Exec(queryStr)
         if err != nil {
             goto Error
@@ -142,21 +329,24 @@ func (d *Datamart) CreateDimensionTables(dimDefs map[string]*DimensionDefinition
         queryStr = fmt.Sprintf(
             `insert into %s 
              select null, %s %s
-             from (select %s, %s sort %s
+             from (select %s, %s %s %s
                    from source
                    where %s is not null
-                   group by %s, sort %s) a
-             order by sort %s;`,
-             name,
-             dim.UniqueColumn,
+                   group by %s, %s %s) a
+             order by %s %s;`,
+             quoteIdentifier(name),
+             quoteIdentifier(dim.UniqueColumn),
              extraStr,
-             dim.UniqueColumn,
+             quoteIdentifier(dim.UniqueColumn),
              dim.SortExpr,
+             sortAlias,
              extraStr,
-             dim.UniqueColumn,
-             dim.UniqueColumn,
+             quoteIdentifier(dim.UniqueColumn),
+             quoteIdentifier(dim.UniqueColumn),
+             sortAlias,
              extraStr,
-             dim.SortDirection,
+             sortAlias,
+             direction,
          )
 
         err = conn.Exec(queryStr)
@@ -165,10 +355,10 @@ func (d *Datamart) CreateDimensionTables(dimDefs map[string]*DimensionDefinition
         }
         
         queryStr = fmt.Sprintf(
-            "create index %s_idx on %s (%s);",
-            dim.UniqueColumn,
-            name,
-            dim.UniqueColumn,
+            "create index %s on %s (%s);",
+            quoteIdentifier(dim.UniqueColumn + "_idx"),
+            quoteIdentifier(name),
+            quoteIdentifier(dim.UniqueColumn),
         )
 
         err = conn.Exec(queryStr)
@@ -187,9 +377,21 @@ func (d *Datamart) CreateDimensionTables(dimDefs map[string]*DimensionDefinition
         )    
 }
 
+// Column names are case insensitive in sqlite
+func (d *Datamart) isSourceColumn(column string) bool {
+    for _, name := range d.SourceTableData.ColumnNames {
+        if strings.EqualFold(name, column) {
+            return true
+        }
+    }
+    return false
+}
+
 func getRowCount(name string, conn *sqlite.Conn) (int, error) {
 
-    stmt, err := conn.Prepare(fmt.Sprintf("select count(1) from %s;", name))
+    stmt, err := conn.Prepare(
+        fmt.Sprintf("select count(1) from %s;", quoteIdentifier(name)),
+    )
     if err != nil {
         return -1, err
     }
@@ -213,50 +415,62 @@ func getRowCount(name string, conn *sqlite.Conn) (int, error) {
 // 1. Matches dimension column, fact row value is id in matching dimesnion table row
 // 2. Is null, and dimension table for column has > 0 rows, fact row value is -1
 // 3. Is null, and dimension table for column has 0 rows, fact row value is -1
+// Measure columns follow with their source values
 func (d *Datamart) CreateFactTable(dimDefs map[string]*DimensionDefinition,
                                    conn *sqlite.Conn) error {
 
     rowCountCache := make(map[string]int)
 
     // make list of non-zero dim tables
-    nzDim := make(map[string]*DimensionDefinition)
-    for name, dim := range dimDefs {
+    names := orderedDimNames(dimDefs)
+    var nzDim []string
+    for _, name := range names {
         count, err := getRowCount(name, conn)
         if err != nil {
             return err
         }
         rowCountCache[name] = count
         if count > 0 {
-            nzDim[name] = dim
+            nzDim = append(nzDim, name)
         }
     }
 
     // make fact table
     query := "create table fact as select"
     i := 0
-    for name, dim := range dimDefs {        
+    for _, name := range names {
+        dim := dimDefs[name]
         if i != 0 {
             query += ","
         }
         if (rowCountCache[name] == 0) {
-            query += " -1 " + dim.IndexColumn
+            query += " -1 " + quoteIdentifier(dim.IndexColumn)
         } else {
             // dim.IndexColumn value - 1 because want ids to start at 0
-            query += " case when source." + dim.UniqueColumn + 
-                     " is null then -1 else " + dim.IndexColumn + " - 1 end " + 
-                     dim.IndexColumn
+            query += " case when source." + quoteIdentifier(dim.UniqueColumn) + 
+                     " is null then -1 else " + quoteIdentifier(name) + "." +
+                     quoteIdentifier(dim.IndexColumn) + " - 1 end " + 
+                     quoteIdentifier(dim.IndexColumn)
+        }
+        i++
+    }
+    for _, measure := range d.measureColumns() {
+        if i != 0 {
+            query += ","
         }
+        query += " source." + quoteIdentifier(measure) + " " + quoteIdentifier(measure)
         i++
     }
     
     query += "\nfrom source"
-    for name, dim := range nzDim {
-        query += " left outer join " + name + " on "
-        query += "source." + dim.UniqueColumn + " = " +  
-                 name + "." + dim.UniqueColumn
+    for _, name := range nzDim {
+        dim := dimDefs[name]
+        query += " left outer join " + quoteIdentifier(name) + " on "
+        query += "source." + quoteIdentifier(dim.UniqueColumn) + " = " +  
+                 quoteIdentifier(name) + "." + quoteIdentifier(dim.UniqueColumn)
     }
 
-    // if all dimension tables a empty return emtpy fact table
+    // if there are no columns return emtpy fact table
     if i == 0 {
         query += "\nwhere "
         query += "1 = 0"
@@ -277,7 +491,99 @@ func (d *Datamart) CreateFactTable(dimDefs map[string]*DimensionDefinition,
 }
 
 
+// Load fact table, measure columns may have NULLs so column types are
+// taken from the source table rather than the first row
+func (d *Datamart) loadFactFromSqlite(dimDefs map[string]*DimensionDefinition,
+                                      s *sqlite.Stmt) (*Table, error) {
+    defer s.Finalize()
+    types := make([]ColumnDatatype, len(dimDefs))
+    for i := range types {
+        types[i] = IntegerDatatype
+    }
+    for _, measure := range d.measureColumns() {
+        types = append(types, d.SourceTableData.ColumnTypes[d.sourceColumnIndex(measure)])
+    }
+
+    info := newEmptyTable()
+    row := make([]interface{}, len(types))
+    data := make([][]byte, len(types))
+    ptrs := make([]interface{}, len(types))
+    for i := range ptrs {
+        ptrs[i] = &data[i]
+    }
+    for s.Next() {
+        if len(info.ColumnNames) == 0 {
+            for i := range types {
+                info.ColumnNames = append(info.ColumnNames, s.ColumnName(i))
+            }
+            info.ColumnTypes = types
+        }
+        err := s.Scan(ptrs...)
+        if err != nil {
+            return nil, err
+        }
+        for i, datatype := range types {
+            if s.ColumnType(i) == sqlite.NullDatatype {
+                row[i] = nil
+                continue
+            }
+            row[i], err = parseValue(string(data[i]), datatype)
+            if err != nil {
+                return nil, fmt.Errorf("loadFactFromSqlite column %s: %s",
+                                       info.ColumnNames[i],
+                                       err.Error())
+            }
+        }
+        err = info.writeRow(row)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return info, nil
+}
+
+func parseValue(s string, datatype ColumnDatatype) (interface{}, error) {
+    switch datatype {
+        case IntegerDatatype:
+            return strconv.ParseInt(s, 10, 64)
+        case FloatDatatype:
+            return strconv.ParseFloat(s, 64)
+    }
+    return s, nil
+}
+
 func (d *Datamart) PerformQueries() (TableSet, error) {
+    err := d.checkColumnProperties()
+    if err != nil {
+        return nil, err
+    }
+    d, err = d.castSource()
+    if err != nil {
+        return nil, err
+    }
+
+    var tables TableSet
+    switch d.Engine {
+        case "", SqliteEngine:
+            tables, err = d.performSqlite()
+        case GoEngine:
+            tables, err = d.performGo()
+        default:
+            return nil, fmt.Errorf("PerformQueries() error, unknown engine %q\n", d.Engine)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    dimDefs := d.SetupDimDefinitions()
+    err = d.expandTimeDimensions(tables, dimDefs)
+    if err != nil || d.Aggregation == nil {
+        return tables, err
+    }
+    return d.aggregateFact(tables, dimDefs)
+}
+
+func (d *Datamart) performSqlite() (TableSet, error) {
 //    os.Remove("/tmp/blah.db")    
 //    conn, err := sqlite.Open("/tmp/blah.db")
     conn, err := sqlite.Open(":memory:")
@@ -314,7 +620,7 @@ func (d *Datamart) PerformQueries() (TableSet, error) {
     if err != nil {
         return nil, err
     }    
-    ret["fact"], err = LoadTableFromSqlite(stmt)
+    ret["fact"], err = d.loadFactFromSqlite(dimDefs, stmt)
     if err != nil {
         return nil, err
     }
@@ -324,17 +630,22 @@ func (d *Datamart) PerformQueries() (TableSet, error) {
     // these selects are more complicated because need ids to start a 0
     // and sqlite auto increment starts at 1
     // annoying
-    for name, dim := range dimDefs {
+    for _, name := range orderedDimNames(dimDefs) {
+        dim := dimDefs[name]
         query := fmt.Sprintf(
             "select %s - 1 %s, %s",
-            dim.IndexColumn,
-            dim.IndexColumn,
-            dim.UniqueColumn,
+            quoteIdentifier(dim.IndexColumn),
+            quoteIdentifier(dim.IndexColumn),
+            quoteIdentifier(dim.UniqueColumn),
         )
-        if len(dim.ExtraColumns) > 0 {
-            query += "," + strings.Join(dim.ExtraColumns, ",")
+        for _, extra := range dim.ExtraColumns {
+            query += "," + quoteIdentifier(extra)
         }
-        query += fmt.Sprintf(" from %s order by %s;", name, dim.IndexColumn)
+        query += fmt.Sprintf(
+            " from %s order by %s;",
+            quoteIdentifier(name),
+            quoteIdentifier(dim.IndexColumn),
+        )
 
         stmt, err := conn.Prepare(query)
         if err != nil {
@@ -358,6 +669,11 @@ func (d *Datamart) PerformQueries() (TableSet, error) {
     if err != nil {
         return nil, err
     }
+
+    ret[MetaTable], err = metaTable(dimDefs, d.measureColumns())
+    if err != nil {
+        return nil, err
+    }
                   
     return ret, nil
 }
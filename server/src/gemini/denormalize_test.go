@@ -6,6 +6,7 @@ import (
     "fmt"
     "bytes"
     "io/ioutil"
+    "reflect"
 )
 
 var gt *testing.T
@@ -69,3 +70,365 @@ func TestDatamart2(t *testing.T) {
     fmt.Println(string(js))
 }
 
+
+// column names that are sqlite keywords or need quoting
+var hostileColumnNames = []string{
+    "order", "group", "my col", `a"b`, "it's", "x.y", "sort", "select", "x_id", "x",
+}
+
+func columnIndex(info *Table, name string) int {
+    for i, column := range info.ColumnNames {
+        if column == name {
+            return i
+        }
+    }
+    return -1
+}
+
+func TestPerformQueriesHostileNames(t *testing.T) {
+    info := &Table{
+        ColumnNames : hostileColumnNames,
+        ColumnTypes : make([]ColumnDatatype, len(hostileColumnNames)),
+    }
+    for i := range info.ColumnTypes {
+        info.ColumnTypes[i] = StringDatatype
+    }
+    info.ColumnTypes[0] = IntegerDatatype
+    info.initData()
+    source := [][]interface{}{
+        {int64(2), "b", "one two", `"`, "'", ".", "z", ";", "drop table source;", "1"},
+        {int64(1), "a", nil, `""`, "''", "..", "y", "--", "x", "2"},
+        {int64(2), "a", "one two", `"`, "'", ".", "z", ";", "drop table source;", nil},
+    }
+    for _, row := range source {
+        fatalOnError(info.writeRow(row), t)
+    }
+
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            // extra column named like the sort alias
+            "sort" : SourceColumnProperty{PartOfDim: "selects"},
+            "order" : SourceColumnProperty{
+                SortExpr: `"order" * -1`,
+                SortDirection: "DESC",
+            },
+        },
+    }
+    tables, err := d.PerformQueries()
+    fatalOnError(err, t)
+
+    fact, err := tableRows(tables["fact"])
+    fatalOnError(err, t)
+    if len(fact) != len(source) {
+        t.Fatalf("fact rows %v", fact)
+    }
+    for _, name := range hostileColumnNames {
+        if name == "sort" {
+            continue
+        }
+        dim := tables[name + "s"]
+        if dim == nil {
+            t.Fatalf("no dimension for %s", name)
+        }
+        if dim.ColumnNames[0] != name + "_id" || dim.ColumnNames[1] != name {
+            t.Errorf("dimension %s columns %v", name, dim.ColumnNames)
+        }
+        dimRows, err := tableRows(dim)
+        fatalOnError(err, t)
+        col := columnIndex(tables["fact"], name + "_id")
+        src := columnIndex(info, name)
+        for i, row := range fact {
+            id := row[col].(int64)
+            var v interface{}
+            if id != -1 {
+                v = dimRows[id][1]
+            }
+            if v != source[i][src] {
+                t.Errorf("column %s row %d value %#v expected %#v", name, i, v, source[i][src])
+            }
+        }
+    }
+
+    orders, err := tableRows(tables["orders"])
+    fatalOnError(err, t)
+    if orders[0][1] != int64(1) || orders[1][1] != int64(2) {
+        t.Errorf("orders not sorted by expression %v", orders)
+    }
+    selects := tables["selects"]
+    if len(selects.ColumnNames) != 3 || selects.ColumnNames[2] != "sort" {
+        t.Errorf("selects columns %v", selects.ColumnNames)
+    }
+}
+
+func TestPerformQueriesBadSortDirection(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route", "distance"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, FloatDatatype},
+    }
+    info.initData()
+    fatalOnError(info.writeRow([]interface{}{"10", 2.0}), t)
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "distance" : SourceColumnProperty{SortDirection: "asc; drop table source"},
+        },
+    }
+    _, err := d.PerformQueries()
+    if err == nil {
+        t.Error("expected error for bad sort direction")
+    }
+}
+
+func TestPerformQueriesDeterministic(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route", "stop", "distance", "delay", "agency"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            StringDatatype,
+            FloatDatatype,
+            IntegerDatatype,
+            StringDatatype,
+        },
+    }
+    info.initData()
+    info.writeRow([]interface{}{"1", "a", 1.5, 3, "x"})
+    info.writeRow([]interface{}{"2", "b", 0.5, nil, "y"})
+    info.writeRow([]interface{}{"1", "b", 0.5, 1, "x"})
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "distance" : SourceColumnProperty{PartOfDim: "stops"},
+            "agency" : SourceColumnProperty{PartOfDim: "routes"},
+        },
+    }
+
+    var first []byte
+    for i := 0; i < 10; i++ {
+        tables, err := d.PerformQueries()
+        fatalOnError(err, t)
+        var buf bytes.Buffer
+        fatalOnError(tables.JSONWrite(&buf), t)
+        if i == 0 {
+            first = buf.Bytes()
+            expected := []string{"route_id", "stop_id", "delay_id"}
+            if !reflect.DeepEqual(tables["fact"].ColumnNames, expected) {
+                t.Errorf("fact columns %v expected %v", tables["fact"].ColumnNames, expected)
+            }
+            names := []string{"fact", "routes", "stops", "delays", "meta"}
+            if !reflect.DeepEqual(tables.Names(), names) {
+                t.Errorf("table names %v expected %v", tables.Names(), names)
+            }
+        } else if !bytes.Equal(buf.Bytes(), first) {
+            t.Fatalf("run %d output\n%s\ndiffers from\n%s", i, buf.Bytes(), first)
+        }
+    }
+}
+
+func TestTableSetNames(t *testing.T) {
+    fact := &Table{ColumnNames : []string{"b_id", "a_id", "missing_id"}}
+    tables := TableSet{
+        "fact" : fact,
+        "as" : &Table{},
+        "bs" : &Table{},
+        "zz" : &Table{},
+        "extra" : &Table{},
+    }
+    expected := []string{"fact", "bs", "as", "extra", "zz"}
+    if names := tables.Names(); !reflect.DeepEqual(names, expected) {
+        t.Errorf("names %v expected %v", names, expected)
+    }
+}
+
+func TestPerformQueriesOrder(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"a", "b", "c", "d", "e"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            StringDatatype,
+            StringDatatype,
+            StringDatatype,
+            StringDatatype,
+        },
+    }
+    info.initData()
+    info.writeRow([]interface{}{"1", "2", "3", "4", "5"})
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "e" : SourceColumnProperty{Order: 1},
+            "b" : SourceColumnProperty{Order: 5},
+            "d" : SourceColumnProperty{Order: 5},
+            "c" : SourceColumnProperty{PartOfDim: "as", Order: 2},
+        },
+    }
+    tables, err := d.PerformQueries()
+    fatalOnError(err, t)
+    expected := []string{"e_id", "b_id", "d_id", "a_id"}
+    if !reflect.DeepEqual(tables["fact"].ColumnNames, expected) {
+        t.Errorf("fact columns %v expected %v", tables["fact"].ColumnNames, expected)
+    }
+    names := []string{"fact", "es", "bs", "ds", "as", "meta"}
+    if !reflect.DeepEqual(tables.Names(), names) {
+        t.Errorf("table names %v expected %v", tables.Names(), names)
+    }
+}
+
+func TestPerformQueriesMeta(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route_short_name", "distance"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, FloatDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"10", 2.0}, {"2", 3.5}, {nil, 1.0}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "distance" : SourceColumnProperty{PartOfDim: "route_short_names"},
+            "route_short_name" : SourceColumnProperty{
+                SortExpr: "distance",
+                SortDirection: "DESC",
+            },
+        },
+    }
+    tables, err := d.PerformQueries()
+    fatalOnError(err, t)
+    columns, err := tables.FactColumns()
+    fatalOnError(err, t)
+    expected := []FactColumn{
+        FactColumn{
+            Column : "route_short_name_id",
+            Dimension : "route_short_names",
+            KeyColumn : "route_short_name_id",
+            UniqueColumn : "route_short_name",
+            ExtraColumns : []string{"distance"},
+            SortExpr : "distance",
+            SortDirection : "desc",
+        },
+    }
+    if !reflect.DeepEqual(columns, expected) {
+        t.Errorf("fact columns %+v expected %+v", columns, expected)
+    }
+
+    // table set without meta uses the naming convention
+    delete(tables, MetaTable)
+    columns, err = tables.FactColumns()
+    fatalOnError(err, t)
+    expected[0].SortExpr = ""
+    expected[0].SortDirection = ""
+    if !reflect.DeepEqual(columns, expected) {
+        t.Errorf("convention fact columns %+v expected %+v", columns, expected)
+    }
+
+    // any other table in place of the meta table
+    bad := TableSet{MetaTable : info}
+    _, err = bad.FactColumns()
+    if err == nil {
+        t.Error("expected error for bad meta table")
+    }
+}
+
+func TestPerformQueriesMeasure(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route", "distance", "fare"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, FloatDatatype, IntegerDatatype},
+    }
+    info.initData()
+    info.writeRow([]interface{}{"10", nil, 300})
+    info.writeRow([]interface{}{"2", 3.5, nil})
+    info.writeRow([]interface{}{"10", 1.0, 250})
+    for _, engine := range []string{SqliteEngine, GoEngine} {
+        d := &Datamart{
+            SourceTableData: info,
+            SourceColumnProperties: map[string]SourceColumnProperty{
+                "distance" : SourceColumnProperty{Measure: true},
+                "fare" : SourceColumnProperty{Measure: true, Order: 1},
+            },
+            Engine: engine,
+        }
+        tables, err := d.PerformQueries()
+        fatalOnError(err, t)
+        names := []string{"fact", "routes", "meta"}
+        if !reflect.DeepEqual(tables.Names(), names) {
+            t.Errorf("%s: tables %v expected %v", engine, tables.Names(), names)
+        }
+        fact := tables["fact"]
+        columnTypes := []ColumnDatatype{IntegerDatatype, FloatDatatype, IntegerDatatype}
+        if !reflect.DeepEqual(fact.ColumnNames, []string{"route_id", "distance", "fare"}) ||
+           !reflect.DeepEqual(fact.ColumnTypes, columnTypes) {
+            t.Errorf("%s: fact columns %v %v", engine, fact.ColumnNames, fact.ColumnTypes)
+        }
+        rows, err := tableRows(fact)
+        fatalOnError(err, t)
+        expected := [][]interface{}{
+            {int64(0), nil, int64(300)},
+            {int64(1), 3.5, nil},
+            {int64(0), 1.0, int64(250)},
+        }
+        if !reflect.DeepEqual(rows, expected) {
+            t.Errorf("%s: fact rows %v expected %v", engine, rows, expected)
+        }
+
+        columns, err := tables.FactColumns()
+        fatalOnError(err, t)
+        if len(columns) != 3 || columns[0].Measure || !columns[1].Measure ||
+           columns[1].Column != "distance" || columns[2].Dimension != "" {
+            t.Errorf("%s: fact columns %+v", engine, columns)
+        }
+
+        db, err := NewDb(tables)
+        fatalOnError(err, t)
+        row, err := db.FactLookup(1)
+        fatalOnError(err, t)
+        joined := map[string]interface{}{
+            "route_id" : int64(1),
+            "route" : "2",
+            "distance" : 3.5,
+            "fare" : nil,
+        }
+        if !reflect.DeepEqual(row, joined) {
+            t.Errorf("%s: fact lookup %v expected %v", engine, row, joined)
+        }
+    }
+}
+
+func TestPerformQueriesNegativeOrder(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route", "distance"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, FloatDatatype},
+    }
+    info.initData()
+    fatalOnError(info.writeRow([]interface{}{"10", 2.0}), t)
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "distance" : SourceColumnProperty{Order: -1},
+        },
+    }
+    if _, err := d.PerformQueries(); err == nil {
+        t.Error("expected error for negative Order")
+    }
+}
+
+func TestPerformQueriesMeasureIndexColumn(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"stop", "stop_id"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, IntegerDatatype},
+    }
+    info.initData()
+    fatalOnError(info.writeRow([]interface{}{"Central", int64(1)}), t)
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "stop_id" : SourceColumnProperty{Measure: true},
+        },
+    }
+    for _, engine := range []string{SqliteEngine, GoEngine} {
+        d.Engine = engine
+        if _, err := d.PerformQueries(); err == nil {
+            t.Errorf("%s: expected error for measure named as an IndexColumn", engine)
+        }
+    }
+}
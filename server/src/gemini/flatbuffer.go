@@ -0,0 +1,268 @@
+package gemini
+
+import (
+    "encoding/binary"
+)
+
+// Just enough of the flatbuffers format to read and write Arrow messages.
+//
+// The builder writes objects front to back, a table is followed by the
+// objects it refers to and those offsets are patched in once the child
+// object has been written. Offsets are relative to the position they are
+// stored at so always point forward.
+
+// field of a table being built, either an inline scalar or a reference to
+// a child object written by child
+type fbField struct {
+    slot int
+    scalar []byte
+    child func(b *fbBuilder) int
+}
+
+type fbBuilder struct {
+    buf []byte
+}
+
+func fbInt16(v int16) []byte {
+    b := make([]byte, 2)
+    binary.LittleEndian.PutUint16(b, uint16(v))
+    return b
+}
+
+func fbInt32(v int32) []byte {
+    b := make([]byte, 4)
+    binary.LittleEndian.PutUint32(b, uint32(v))
+    return b
+}
+
+func fbInt64(v int64) []byte {
+    b := make([]byte, 8)
+    binary.LittleEndian.PutUint64(b, uint64(v))
+    return b
+}
+
+func (f fbField) size() int {
+    if f.child != nil {
+        return 4
+    }
+    return len(f.scalar)
+}
+
+// zero pad so that after writing size more bytes the position is aligned
+func (b *fbBuilder) align(size, alignment int) {
+    for (len(b.buf) + size) % alignment != 0 {
+        b.buf = append(b.buf, 0)
+    }
+}
+
+func (b *fbBuilder) appendUint16(v int) {
+    b.buf = append(b.buf, byte(v), byte(v >> 8))
+}
+
+func (b *fbBuilder) appendUint32(v int) {
+    b.buf = append(b.buf, byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24))
+}
+
+// set offset stored at pos to point at target
+func (b *fbBuilder) patch(pos, target int) {
+    binary.LittleEndian.PutUint32(b.buf[pos:], uint32(target - pos))
+}
+
+// Build buffer with root table, padded to 8 bytes
+func (b *fbBuilder) finish(root []fbField) []byte {
+    b.buf = make([]byte, 4)
+    b.patch(0, b.table(root))
+    b.align(0, 8)
+    return b.buf
+}
+
+func (b *fbBuilder) table(fields []fbField) int {
+    // largest fields first so every field is aligned to its size
+    sorted := make([]fbField, 0, len(fields))
+    slots := 0
+    for _, size := range []int{8, 4, 2, 1} {
+        for _, f := range fields {
+            if f.size() == size {
+                sorted = append(sorted, f)
+            }
+        }
+    }
+    for _, f := range fields {
+        if f.slot + 1 > slots {
+            slots = f.slot + 1
+        }
+    }
+
+    offsets := make([]int, slots)
+    inline := 4
+    for _, f := range sorted {
+        offsets[f.slot] = inline
+        inline += f.size()
+    }
+
+    // vtable goes before the table
+    b.align(0, 2)
+    vtable := len(b.buf)
+    b.appendUint16(4 + 2 * slots)
+    b.appendUint16(inline)
+    for _, o := range offsets {
+        b.appendUint16(o)
+    }
+
+    b.align(4, 8)
+    pos := len(b.buf)
+    b.appendUint32(pos - vtable)
+    refs := make([]int, len(sorted))
+    for i, f := range sorted {
+        refs[i] = len(b.buf)
+        if f.child != nil {
+            b.appendUint32(0)
+        } else {
+            b.buf = append(b.buf, f.scalar...)
+        }
+    }
+    for i, f := range sorted {
+        if f.child != nil {
+            b.patch(refs[i], f.child(b))
+        }
+    }
+    return pos
+}
+
+func fbTableRef(fields []fbField) func(b *fbBuilder) int {
+    return func(b *fbBuilder) int {
+        return b.table(fields)
+    }
+}
+
+func fbString(s string) func(b *fbBuilder) int {
+    return func(b *fbBuilder) int {
+        b.align(0, 4)
+        pos := len(b.buf)
+        b.appendUint32(len(s))
+        b.buf = append(b.buf, s...)
+        b.buf = append(b.buf, 0)
+        return pos
+    }
+}
+
+func fbTableVector(tables [][]fbField) func(b *fbBuilder) int {
+    return func(b *fbBuilder) int {
+        b.align(0, 4)
+        pos := len(b.buf)
+        b.appendUint32(len(tables))
+        for i := 0; i < len(tables); i++ {
+            b.appendUint32(0)
+        }
+        for i, fields := range tables {
+            b.patch(pos + 4 + 4 * i, b.table(fields))
+        }
+        return pos
+    }
+}
+
+// vector of structs made of two int64s
+func fbStructVector(values []int64) func(b *fbBuilder) int {
+    return func(b *fbBuilder) int {
+        b.align(4, 8)
+        pos := len(b.buf)
+        b.appendUint32(len(values) / 2)
+        for _, v := range values {
+            b.buf = append(b.buf, fbInt64(v)...)
+        }
+        return pos
+    }
+}
+
+// table in a buffer being read, out of range offsets panic
+type fbTable struct {
+    buf []byte
+    pos int
+}
+
+func fbRoot(buf []byte) *fbTable {
+    return fbDeref(buf, 0)
+}
+
+func fbDeref(buf []byte, pos int) *fbTable {
+    return &fbTable{buf, pos + int(binary.LittleEndian.Uint32(buf[pos:]))}
+}
+
+// position of field in slot, 0 if not present
+func (t *fbTable) field(slot int) int {
+    vtable := t.pos - int(int32(binary.LittleEndian.Uint32(t.buf[t.pos:])))
+    size := int(binary.LittleEndian.Uint16(t.buf[vtable:]))
+    if 4 + 2 * slot + 2 > size {
+        return 0
+    }
+    offset := int(binary.LittleEndian.Uint16(t.buf[vtable + 4 + 2 * slot:]))
+    if offset == 0 {
+        return 0
+    }
+    return t.pos + offset
+}
+
+func (t *fbTable) uint8(slot int, def uint8) uint8 {
+    if p := t.field(slot); p != 0 {
+        return t.buf[p]
+    }
+    return def
+}
+
+func (t *fbTable) int16(slot int, def int16) int16 {
+    if p := t.field(slot); p != 0 {
+        return int16(binary.LittleEndian.Uint16(t.buf[p:]))
+    }
+    return def
+}
+
+func (t *fbTable) int32(slot int, def int32) int32 {
+    if p := t.field(slot); p != 0 {
+        return int32(binary.LittleEndian.Uint32(t.buf[p:]))
+    }
+    return def
+}
+
+func (t *fbTable) int64(slot int, def int64) int64 {
+    if p := t.field(slot); p != 0 {
+        return int64(binary.LittleEndian.Uint64(t.buf[p:]))
+    }
+    return def
+}
+
+func (t *fbTable) table(slot int) (*fbTable, bool) {
+    if p := t.field(slot); p != 0 {
+        return fbDeref(t.buf, p), true
+    }
+    return nil, false
+}
+
+func (t *fbTable) string(slot int) string {
+    p := t.field(slot)
+    if p == 0 {
+        return ""
+    }
+    p += int(binary.LittleEndian.Uint32(t.buf[p:]))
+    length := int(binary.LittleEndian.Uint32(t.buf[p:]))
+    return string(t.buf[p + 4:p + 4 + length])
+}
+
+// start of elements and length of vector in slot
+func (t *fbTable) vector(slot int) (int, int) {
+    p := t.field(slot)
+    if p == 0 {
+        return 0, 0
+    }
+    p += int(binary.LittleEndian.Uint32(t.buf[p:]))
+    return p + 4, int(binary.LittleEndian.Uint32(t.buf[p:]))
+}
+
+// element i of vector of tables starting at start
+func (t *fbTable) tableAt(start, i int) *fbTable {
+    return fbDeref(t.buf, start + 4 * i)
+}
+
+// int64 n of element i of vector of two int64 structs starting at start
+func (t *fbTable) structInt64(start, i, n int) int64 {
+    return int64(binary.LittleEndian.Uint64(t.buf[start + 16 * i + 8 * n:]))
+}
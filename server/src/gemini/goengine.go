@@ -0,0 +1,353 @@
+package gemini
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Dimension of the Go engine. Rows of the dimension are the distinct
+// (unique, sort, extras...) tuples of the source rows with a unique value,
+// as the sqlite engine's group by gives.
+type goDim struct {
+    name string
+    def *DimensionDefinition
+    // source column indexes of unique, sort and extra columns
+    columns []int
+    desc bool
+    tuples [][]interface{}
+    // ids of rows with the unique value, keyed by valueKey
+    ids map[string][]int64
+}
+
+// Build the same TableSet as performSqlite with maps and sorting
+func (d *Datamart) performGo() (TableSet, error) {
+    src := d.SourceTableData
+    rows, err := tableRows(src)
+    if err != nil {
+        return nil, err
+    }
+
+    dimDefs := d.SetupDimDefinitions()
+    names := orderedDimNames(dimDefs)
+    dims := make([]*goDim, len(names))
+    for i, name := range names {
+        dims[i], err = d.newGoDim(name, dimDefs[name])
+        if err != nil {
+            return nil, err
+        }
+        dims[i].build(rows)
+    }
+
+    ret := make(TableSet)
+    var measures []int
+    for _, measure := range d.measureColumns() {
+        measures = append(measures, d.sourceColumnIndex(measure))
+    }
+    ret["fact"], err = goFactTable(dims, measures, src, rows)
+    if err != nil {
+        return nil, err
+    }
+    for _, dim := range dims {
+        ret[dim.name], err = dim.table(src)
+        if err != nil {
+            return nil, err
+        }
+    }
+    ret[MetaTable], err = metaTable(dimDefs, d.measureColumns())
+    if err != nil {
+        return nil, err
+    }
+    return ret, nil
+}
+
+func (d *Datamart) newGoDim(name string, def *DimensionDefinition) (*goDim, error) {
+    direction := strings.ToLower(def.SortDirection)
+    if direction != Asc && direction != Desc {
+        return nil, fmt.Errorf(
+            "performGo() error, bad sort direction %q for %s\n",
+            def.SortDirection,
+            name,
+        )
+    }
+    dim := &goDim{
+        name : name,
+        def : def,
+        desc : direction == Desc,
+        ids : make(map[string][]int64),
+    }
+
+    sortColumn := d.sortExprColumn(def.SortExpr)
+    if sortColumn == "" {
+        return nil, fmt.Errorf(
+            "performGo() error, sort expression %s for %s is not a source column\n",
+            def.SortExpr,
+            name,
+        )
+    }
+    for _, column := range append([]string{def.UniqueColumn, sortColumn}, def.ExtraColumns...) {
+        dim.columns = append(dim.columns, d.sourceColumnIndex(column))
+    }
+    return dim, nil
+}
+
+// Source column a SortExpr names, either quoted or plain, "" if it is any
+// other expression
+func (d *Datamart) sortExprColumn(expr string) string {
+    expr = strings.TrimSpace(expr)
+    if len(expr) >= 2 && expr[0] == '"' && expr[len(expr) - 1] == '"' {
+        column := strings.Replace(expr[1:len(expr) - 1], `""`, `"`, -1)
+        if quoteIdentifier(column) == expr && d.isSourceColumn(column) {
+            return column
+        }
+        return ""
+    }
+    for _, c := range expr {
+        if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+            return ""
+        }
+    }
+    if d.isSourceColumn(expr) {
+        return expr
+    }
+    return ""
+}
+
+// index of source column, matched as isSourceColumn does
+func (d *Datamart) sourceColumnIndex(column string) int {
+    for i, name := range d.SourceTableData.ColumnNames {
+        if name == column {
+            return i
+        }
+    }
+    for i, name := range d.SourceTableData.ColumnNames {
+        if strings.EqualFold(name, column) {
+            return i
+        }
+    }
+    return -1
+}
+
+func (dim *goDim) build(rows [][]interface{}) {
+    seen := make(map[string]bool)
+    for _, row := range rows {
+        tuple := make([]interface{}, len(dim.columns))
+        for i, column := range dim.columns {
+            tuple[i] = row[column]
+        }
+        if tuple[0] == nil {
+            continue
+        }
+        key := valueKey(tuple...)
+        if !seen[key] {
+            seen[key] = true
+            dim.tuples = append(dim.tuples, tuple)
+        }
+    }
+    sort.Sort(tupleOrder{dim.tuples, dim.desc})
+
+    for i, tuple := range dim.tuples {
+        key := valueKey(tuple[0])
+        dim.ids[key] = append(dim.ids[key], int64(i))
+    }
+}
+
+// dimension table, with id, unique and extra columns
+func (dim *goDim) table(src *Table) (*Table, error) {
+    info := newEmptyTable()
+    if len(dim.tuples) > 0 {
+        info.ColumnNames = []string{dim.def.IndexColumn, dim.def.UniqueColumn}
+        info.ColumnTypes = []ColumnDatatype{IntegerDatatype, src.ColumnTypes[dim.columns[0]]}
+        for i, extra := range dim.def.ExtraColumns {
+            info.ColumnNames = append(info.ColumnNames, extra)
+            info.ColumnTypes = append(info.ColumnTypes, src.ColumnTypes[dim.columns[i + 2]])
+        }
+    }
+    for i, tuple := range dim.tuples {
+        row := append([]interface{}{int64(i), tuple[0]}, tuple[2:]...)
+        err := info.writeRow(row)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return info, nil
+}
+
+// sqlite engine takes column types from the first row so a table without
+// rows has no columns, as LoadTableFromSqlite gives
+func newEmptyTable() *Table {
+    info := &Table{
+        ColumnNames : make([]string, 0),
+        ColumnTypes : make([]ColumnDatatype, 0),
+    }
+    info.initData()
+    return info
+}
+
+// Fact table as the sqlite engine's left outer join of source to the
+// dimensions gives: a row per combination of the dimension rows matching
+// a source row, the first dimension's ids changing slowest, followed by
+// the source row's values of the measure columns
+func goFactTable(dims []*goDim, measures []int, src *Table,
+                 rows [][]interface{}) (*Table, error) {
+    info := newEmptyTable()
+    if len(dims) + len(measures) == 0 {
+        return info, nil
+    }
+    var columnNames []string
+    var columnTypes []ColumnDatatype
+    for _, dim := range dims {
+        columnNames = append(columnNames, dim.def.IndexColumn)
+        columnTypes = append(columnTypes, IntegerDatatype)
+    }
+    for _, measure := range measures {
+        columnNames = append(columnNames, src.ColumnNames[measure])
+        columnTypes = append(columnTypes, src.ColumnTypes[measure])
+    }
+
+    nullId := []int64{-1}
+    matches := make([][]int64, len(dims))
+    for _, row := range rows {
+        for i, dim := range dims {
+            unique := row[dim.columns[0]]
+            if unique == nil || len(dim.tuples) == 0 {
+                matches[i] = nullId
+            } else {
+                matches[i] = dim.ids[valueKey(unique)]
+            }
+        }
+        // odometer over the matches, last dimension fastest
+        counter := make([]int, len(dims))
+        for {
+            values := make([]interface{}, 0, len(columnNames))
+            for i, ids := range matches {
+                values = append(values, ids[counter[i]])
+            }
+            for _, measure := range measures {
+                values = append(values, row[measure])
+            }
+            if len(info.ColumnNames) == 0 {
+                info.ColumnNames = columnNames
+                info.ColumnTypes = columnTypes
+            }
+            err := info.writeRow(values)
+            if err != nil {
+                return nil, err
+            }
+            i := len(counter) - 1
+            for ; i >= 0; i-- {
+                counter[i]++
+                if counter[i] < len(matches[i]) {
+                    break
+                }
+                counter[i] = 0
+            }
+            if i < 0 {
+                break
+            }
+        }
+    }
+    return info, nil
+}
+
+// key identifying values, as sqlite compares them for equality
+func valueKey(values ...interface{}) string {
+    var buf []byte
+    for _, v := range values {
+        switch v := v.(type) {
+            case int64:
+                buf = strconv.AppendInt(append(buf, 'i'), v, 10)
+            case float64:
+                // whole floats equal integers in sqlite
+                if v == float64(int64(v)) {
+                    buf = strconv.AppendInt(append(buf, 'i'), int64(v), 10)
+                } else {
+                    buf = strconv.AppendFloat(append(buf, 'f'), v, 'g', -1, 64)
+                }
+            case string:
+                buf = strconv.AppendQuote(append(buf, 's'), v)
+            default:
+                buf = append(buf, 'n')
+        }
+        buf = append(buf, ',')
+    }
+    return string(buf)
+}
+
+// sqlite ordering: NULL, then numbers, then text in byte order
+func compareValues(a, b interface{}) int {
+    rank := func(v interface{}) int {
+        switch v.(type) {
+            case nil:
+                return 0
+            case int64, float64:
+                return 1
+        }
+        return 2
+    }
+    if rank(a) != rank(b) {
+        return rank(a) - rank(b)
+    }
+    switch a := a.(type) {
+        case string:
+            return strings.Compare(a, b.(string))
+        case int64:
+            if b, ok := b.(int64); ok {
+                switch {
+                    case a < b:
+                        return -1
+                    case a > b:
+                        return 1
+                }
+                return 0
+            }
+            return compareFloats(float64(a), b.(float64))
+        case float64:
+            if b, ok := b.(int64); ok {
+                return compareFloats(a, float64(b))
+            }
+            return compareFloats(a, b.(float64))
+    }
+    return 0
+}
+
+func compareFloats(a, b float64) int {
+    switch {
+        case a < b:
+            return -1
+        case a > b:
+            return 1
+    }
+    return 0
+}
+
+// orders dimension tuples by sort value in the sort direction, ties in
+// the group by order of the tuples
+type tupleOrder struct {
+    tuples [][]interface{}
+    desc bool
+}
+
+func (o tupleOrder) Len() int {
+    return len(o.tuples)
+}
+
+func (o tupleOrder) Less(i, j int) bool {
+    a, b := o.tuples[i], o.tuples[j]
+    c := compareValues(a[1], b[1])
+    if c != 0 {
+        return (c < 0) != o.desc
+    }
+    for k := range a {
+        c = compareValues(a[k], b[k])
+        if c != 0 {
+            return c < 0
+        }
+    }
+    return false
+}
+
+func (o tupleOrder) Swap(i, j int) {
+    o.tuples[i], o.tuples[j] = o.tuples[j], o.tuples[i]
+}
@@ -0,0 +1,140 @@
+package gemini
+
+import (
+    "reflect"
+    "testing"
+)
+
+// run d with both engines, the Go engine must give the same tables
+func compareEngines(d *Datamart, t *testing.T) TableSet {
+    d.Engine = SqliteEngine
+    expected, err := d.PerformQueries()
+    fatalOnError(err, t)
+    d.Engine = GoEngine
+    tables, err := d.PerformQueries()
+    fatalOnError(err, t)
+
+    if !reflect.DeepEqual(tables.Names(), expected.Names()) {
+        t.Fatalf("tables %v expected %v", tables.Names(), expected.Names())
+    }
+    for name, table := range expected {
+        if !reflect.DeepEqual(tables[name].ColumnNames, table.ColumnNames) ||
+           !reflect.DeepEqual(tables[name].ColumnTypes, table.ColumnTypes) {
+            t.Errorf("%s columns %v %v expected %v %v", name,
+                     tables[name].ColumnNames, tables[name].ColumnTypes,
+                     table.ColumnNames, table.ColumnTypes)
+        }
+        rows, err := tableRows(tables[name])
+        fatalOnError(err, t)
+        expectedRows, err := tableRows(table)
+        fatalOnError(err, t)
+        if !reflect.DeepEqual(rows, expectedRows) {
+            t.Errorf("%s rows %v expected %v", name, rows, expectedRows)
+        }
+    }
+    return tables
+}
+
+func TestGoEngine(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route", "Stop", "distance", "delay"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            StringDatatype,
+            FloatDatatype,
+            IntegerDatatype,
+        },
+    }
+    info.initData()
+    for _, row := range [][]interface{}{
+        {"10", "b", 2.5, 3},
+        {"2", "a", 1.0, -1},
+        {"N1", nil, 2.5, 3},
+        {nil, "c", 0.5, 0},
+        {"10", "b", 2.5, 3},
+        {"2", "b", 7.0, 10},
+        {"N1", "a", 1.0, 3},
+    } {
+        fatalOnError(info.writeRow(row), t)
+    }
+
+    props := []map[string]SourceColumnProperty{
+        nil,
+        {
+            "distance" : SourceColumnProperty{PartOfDim: "Stops"},
+            "delay" : SourceColumnProperty{SortDirection: "DESC", Order: 1},
+        },
+        // a sort column that differs between rows of a unique value gives
+        // several dimension rows for it and fact rows for each
+        {
+            "route" : SourceColumnProperty{SortExpr: `"distance"`, SortDirection: Desc},
+            "Stop" : SourceColumnProperty{SortExpr: "delay"},
+            "distance" : SourceColumnProperty{PartOfDim: "routes"},
+        },
+        {
+            "Stop" : SourceColumnProperty{SortExpr: "STOP", SortDirection: Desc},
+            "delay" : SourceColumnProperty{Cast: StringDatatype},
+        },
+        {
+            "route" : SourceColumnProperty{SortExpr: "distance"},
+            "distance" : SourceColumnProperty{Measure: true},
+            "delay" : SourceColumnProperty{Measure: true, PartOfDim: "Stops"},
+        },
+        {
+            "route" : SourceColumnProperty{Measure: true},
+            "Stop" : SourceColumnProperty{Measure: true},
+            "distance" : SourceColumnProperty{Measure: true},
+            "delay" : SourceColumnProperty{Measure: true},
+        },
+    }
+    for _, p := range props {
+        compareEngines(&Datamart{SourceTableData: info, SourceColumnProperties: p}, t)
+    }
+
+    empty := &Table{ColumnNames : info.ColumnNames, ColumnTypes : info.ColumnTypes}
+    empty.initData()
+    compareEngines(&Datamart{SourceTableData: empty}, t)
+}
+
+func TestGoEngineNullColumn(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"name", "note"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, StringDatatype},
+    }
+    info.initData()
+    info.writeRow([]interface{}{"tim", nil})
+    info.writeRow([]interface{}{"scarlet", nil})
+    tables := compareEngines(&Datamart{SourceTableData: info}, t)
+    if len(tables["notes"].ColumnNames) != 0 {
+        t.Errorf("notes columns %v", tables["notes"].ColumnNames)
+    }
+}
+
+func TestGoEngineErrors(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route", "distance"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, FloatDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"10", 2.0}, {"2", 3.5}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    for _, p := range []map[string]SourceColumnProperty{
+        {"distance" : SourceColumnProperty{SortExpr: `"distance" * -1`}},
+        {"distance" : SourceColumnProperty{SortExpr: `"height"`}},
+        {"distance" : SourceColumnProperty{SortDirection: "up"}},
+    } {
+        d := &Datamart{
+            SourceTableData: info,
+            SourceColumnProperties: p,
+            Engine: GoEngine,
+        }
+        if _, err := d.PerformQueries(); err == nil {
+            t.Errorf("expected error for %v", p)
+        }
+    }
+    d := &Datamart{SourceTableData: info, Engine: "mysql"}
+    if _, err := d.PerformQueries(); err == nil {
+        t.Error("expected error for unknown engine")
+    }
+}
@@ -0,0 +1,239 @@
+package gemini
+
+import (
+    "archive/zip"
+    "encoding/csv"
+    "fmt"
+    "io"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// GTFS field kinds, parsed into table column datatypes:
+//
+// gtfsString:  string
+// gtfsInteger: integer
+// gtfsFloat:   float
+// gtfsTime:    integer, seconds after midnight of the service day.
+//              "HH:MM:SS" may be past 24:00:00 for trips running after
+//              midnight, eg. 25:35:00 is 92100
+// gtfsDate:    string, "YYYYMMDD" as "YYYY-MM-DD"
+//
+// Columns not listed are loaded as strings, empty values are NULL.
+const (
+    gtfsString = iota
+    gtfsInteger
+    gtfsFloat
+    gtfsTime
+    gtfsDate
+)
+
+var gtfsFieldKinds map[string]map[string]int = map[string]map[string]int{
+    "agency" : map[string]int{},
+    "routes" : map[string]int{
+        "route_type" : gtfsInteger,
+        "route_sort_order" : gtfsInteger,
+        "continuous_pickup" : gtfsInteger,
+        "continuous_drop_off" : gtfsInteger,
+    },
+    "trips" : map[string]int{
+        "direction_id" : gtfsInteger,
+        "wheelchair_accessible" : gtfsInteger,
+        "bikes_allowed" : gtfsInteger,
+    },
+    "stops" : map[string]int{
+        "stop_lat" : gtfsFloat,
+        "stop_lon" : gtfsFloat,
+        "location_type" : gtfsInteger,
+        "wheelchair_boarding" : gtfsInteger,
+    },
+    "stop_times" : map[string]int{
+        "arrival_time" : gtfsTime,
+        "departure_time" : gtfsTime,
+        "stop_sequence" : gtfsInteger,
+        "pickup_type" : gtfsInteger,
+        "drop_off_type" : gtfsInteger,
+        "continuous_pickup" : gtfsInteger,
+        "continuous_drop_off" : gtfsInteger,
+        "shape_dist_traveled" : gtfsFloat,
+        "timepoint" : gtfsInteger,
+    },
+    "calendar" : map[string]int{
+        "monday" : gtfsInteger,
+        "tuesday" : gtfsInteger,
+        "wednesday" : gtfsInteger,
+        "thursday" : gtfsInteger,
+        "friday" : gtfsInteger,
+        "saturday" : gtfsInteger,
+        "sunday" : gtfsInteger,
+        "start_date" : gtfsDate,
+        "end_date" : gtfsDate,
+    },
+}
+
+// calendar.txt is optional in a feed, without it the calendar table is empty
+var gtfsCalendarColumns []string = []string{
+    "service_id", "monday", "tuesday", "wednesday", "thursday", "friday",
+    "saturday", "sunday", "start_date", "end_date",
+}
+
+var mapGTFSKindToDatatype map[int]ColumnDatatype = map[int]ColumnDatatype{
+    gtfsString : StringDatatype,
+    gtfsInteger : IntegerDatatype,
+    gtfsFloat : FloatDatatype,
+    gtfsTime : IntegerDatatype,
+    gtfsDate : StringDatatype,
+}
+
+// Load GTFS feed zip file into a TableSet with the tables agency, routes,
+// trips, stops, stop_times and calendar, named after the feed files
+func LoadTableSetFromGTFS(filename string) (TableSet, error) {
+    r, err := zip.OpenReader(filename)
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+
+    files := make(map[string]*zip.File)
+    for _, f := range r.File {
+        files[path.Base(f.Name)] = f
+    }
+
+    ret := make(TableSet)
+    for name := range gtfsFieldKinds {
+        f, ok := files[name + ".txt"]
+        if !ok {
+            if name == "calendar" {
+                ret[name] = emptyGTFSTable(name, gtfsCalendarColumns)
+                continue
+            }
+            return nil, fmt.Errorf(
+                "LoadTableSetFromGTFS feed is missing %s.txt\n",
+                name,
+            )
+        }
+
+        rc, err := f.Open()
+        if err != nil {
+            return nil, err
+        }
+        ret[name], err = loadGTFSFile(name, rc)
+        rc.Close()
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return ret, nil
+}
+
+func emptyGTFSTable(name string, columns []string) *Table {
+    var info Table
+    info.ColumnNames = columns
+    info.ColumnTypes = make([]ColumnDatatype, len(columns))
+    for i, column := range columns {
+        info.ColumnTypes[i] = mapGTFSKindToDatatype[gtfsFieldKinds[name][column]]
+    }
+    info.initData()
+    return &info
+}
+
+func loadGTFSFile(name string, r io.Reader) (*Table, error) {
+    cr := csv.NewReader(r)
+    cr.FieldsPerRecord = -1
+    cr.TrimLeadingSpace = true
+
+    header, err := cr.Read()
+    if err != nil {
+        return nil, fmt.Errorf("LoadTableSetFromGTFS %s.txt: %s\n", name, err.Error())
+    }
+    for i := 0; i < len(header); i++ {
+        header[i] = strings.TrimSpace(header[i])
+    }
+    if len(header) > 0 {
+        header[0] = strings.TrimPrefix(header[0], "\ufeff")
+    }
+
+    info := emptyGTFSTable(name, header)
+    kinds := make([]int, len(header))
+    for i, column := range header {
+        kinds[i] = gtfsFieldKinds[name][column]
+    }
+
+    values := make([]interface{}, len(header))
+    for line := 2;; line++ {
+        record, err := cr.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("LoadTableSetFromGTFS %s.txt: %s\n", name, err.Error())
+        }
+        // skip blank lines some feeds end with
+        if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+            continue
+        }
+        for i := 0; i < len(header); i++ {
+            values[i] = nil
+            if i >= len(record) {
+                continue
+            }
+            values[i], err = parseGTFSValue(kinds[i], strings.TrimSpace(record[i]))
+            if err != nil {
+                return nil, fmt.Errorf(
+                    "LoadTableSetFromGTFS %s.txt line %d column %s: %s\n",
+                    name,
+                    line,
+                    header[i],
+                    err.Error(),
+                )
+            }
+        }
+        err = info.writeRow(values)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return info, nil
+}
+
+func parseGTFSValue(kind int, s string) (interface{}, error) {
+    if s == "" {
+        return nil, nil
+    }
+    switch kind {
+        case gtfsInteger:
+            return strconv.ParseInt(s, 10, 64)
+        case gtfsFloat:
+            return strconv.ParseFloat(s, 64)
+        case gtfsTime:
+            return parseGTFSTime(s)
+        case gtfsDate:
+            d, err := time.Parse("20060102", s)
+            if err != nil {
+                return nil, err
+            }
+            return d.Format("2006-01-02"), nil
+    }
+    return s, nil
+}
+
+// "H:MM:SS" or "HH:MM:SS" to seconds, hours may be 24 or more
+func parseGTFSTime(s string) (int64, error) {
+    parts := strings.Split(s, ":")
+    if len(parts) != 3 {
+        return 0, fmt.Errorf("bad time %s", s)
+    }
+    var hms [3]int64
+    for i, part := range parts {
+        v, err := strconv.ParseInt(part, 10, 64)
+        if err != nil || v < 0 || (i > 0 && (v > 59 || len(part) != 2)) {
+            return 0, fmt.Errorf("bad time %s", s)
+        }
+        hms[i] = v
+    }
+    return hms[0] * 3600 + hms[1] * 60 + hms[2], nil
+}
@@ -0,0 +1,115 @@
+package gemini
+
+import (
+    "archive/zip"
+    "testing"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+)
+
+var gtfsTestFeed = map[string]string{
+    "agency.txt" : "agency_id,agency_name,agency_url,agency_timezone\n" +
+        "MET,Metlink,http://metlink.org.nz,Pacific/Auckland\n",
+    "routes.txt" : "\ufeffroute_id,agency_id,route_short_name,route_long_name,route_type\n" +
+        "R1,MET,1,Island Bay - Karori,3\n" +
+        "R2,MET,\"2\",\"Miramar, Karori\",3\n",
+    "trips.txt" : "route_id,service_id,trip_id,direction_id\n" +
+        "R1,WK,T1,0\n" +
+        "R2,WK,T2,\n",
+    "stops.txt" : "stop_id,stop_name,stop_lat,stop_lon\n" +
+        "S1,Courtenay Place,-41.2935,174.7802\n",
+    "stop_times.txt" : "trip_id,arrival_time,departure_time,stop_id,stop_sequence\n" +
+        "T1,5:30:00,05:30:00,S1,1\n" +
+        "T2,25:35:00,25:36:10,S1,1\n" +
+        "T2,,,S1,2\n",
+}
+
+func writeGTFSTestFeed(t *testing.T, files map[string]string) string {
+    dir, err := ioutil.TempDir("", "gtfs")
+    fatalOnError(err, t)
+    name := filepath.Join(dir, "feed.zip")
+    f, err := os.Create(name)
+    fatalOnError(err, t)
+    zw := zip.NewWriter(f)
+    for file, content := range files {
+        w, err := zw.Create(file)
+        fatalOnError(err, t)
+        _, err = w.Write([]byte(content))
+        fatalOnError(err, t)
+    }
+    fatalOnError(zw.Close(), t)
+    fatalOnError(f.Close(), t)
+    return name
+}
+
+func TestLoadTableSetFromGTFS(t *testing.T) {
+    name := writeGTFSTestFeed(t, gtfsTestFeed)
+    defer os.RemoveAll(filepath.Dir(name))
+
+    tables, err := LoadTableSetFromGTFS(name)
+    fatalOnError(err, t)
+    for _, table := range []string{"agency", "routes", "trips", "stops",
+                                   "stop_times", "calendar"} {
+        if tables[table] == nil {
+            t.Fatalf("missing table %s", table)
+        }
+    }
+
+    routes := tables["routes"]
+    if routes.ColumnNames[0] != "route_id" {
+        t.Errorf("byte order mark not stripped %q", routes.ColumnNames[0])
+    }
+    if routes.ColumnTypes[4] != IntegerDatatype {
+        t.Errorf("route_type is %s", routes.ColumnTypes[4])
+    }
+    rows, err := tableRows(routes)
+    fatalOnError(err, t)
+    if rows[1][3] != "Miramar, Karori" || rows[1][4] != int64(3) {
+        t.Errorf("routes row %v", rows[1])
+    }
+
+    stopTimes := tables["stop_times"]
+    if stopTimes.ColumnTypes[1] != IntegerDatatype {
+        t.Errorf("arrival_time is %s", stopTimes.ColumnTypes[1])
+    }
+    rows, err = tableRows(stopTimes)
+    fatalOnError(err, t)
+    if rows[0][1] != int64(19800) || rows[1][1] != int64(92100) ||
+       rows[1][2] != int64(92170) || rows[2][1] != nil {
+        t.Errorf("stop_times rows %v", rows)
+    }
+
+    rows, err = tableRows(tables["stops"])
+    fatalOnError(err, t)
+    if rows[0][2] != -41.2935 {
+        t.Errorf("stop_lat %v", rows[0][2])
+    }
+
+    if tables["calendar"].rowCount() != 0 ||
+       len(tables["calendar"].ColumnNames) != len(gtfsCalendarColumns) {
+        t.Error("calendar not empty table")
+    }
+}
+
+func TestLoadTableSetFromGTFSErrors(t *testing.T) {
+    bad := make(map[string]string)
+    for k, v := range gtfsTestFeed {
+        bad[k] = v
+    }
+    bad["stop_times.txt"] = "trip_id,arrival_time\nT1,5:61:00\n"
+    name := writeGTFSTestFeed(t, bad)
+    defer os.RemoveAll(filepath.Dir(name))
+    _, err := LoadTableSetFromGTFS(name)
+    if err == nil {
+        t.Error("expected error for bad time")
+    }
+
+    delete(bad, "stops.txt")
+    name = writeGTFSTestFeed(t, bad)
+    defer os.RemoveAll(filepath.Dir(name))
+    _, err = LoadTableSetFromGTFS(name)
+    if err == nil {
+        t.Error("expected error for missing stops.txt")
+    }
+}
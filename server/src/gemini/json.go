@@ -0,0 +1,569 @@
+package gemini
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+)
+
+// JSONOptions Format values
+const (
+    // {"ColumnNames":[...], "ColumnTypes":[...], "Data":[...]}, Data holds
+    // an array of values per row
+    JSONRows string = "rows"
+    // {"ColumnNames":[...], "ColumnTypes":[...], "Columns":[...]}, Columns
+    // holds an array of values per column, NULL is null
+    JSONColumns string = "columns"
+    // [{"column":value,...},...], an object per row as in the client's
+    // data bundles, a table set is an object of table name to that array
+    JSONObjects string = "objects"
+)
+
+// JSONOptions NonFinite values, how NaN and infinite floats are written
+const (
+    // null
+    JSONNonFiniteNull string = "null"
+    // "NaN", "Infinity" or "-Infinity", as JavaScript's String() gives
+    JSONNonFiniteString string = "string"
+    // JSONWrite returns an error before writing anything
+    JSONNonFiniteError string = "error"
+)
+
+// JSONOptions LargeIntegers values, how integers a JavaScript number can't
+// hold exactly (beyond +/-(2^53 - 1)) are written
+const (
+    // as a decimal string, eg. "9007199254740993"
+    JSONLargeString string = "string"
+    // as a number, a JavaScript client rounds it. The default, as
+    // JSONWrite has always written them
+    JSONLargeNumber string = "number"
+)
+
+// largest integer a float64 holds with every smaller integer
+const maxSafeInteger = 1 << 53 - 1
+
+type JSONOptions struct {
+    // JSONRows if not set
+    Format string
+    // JSONNonFiniteNull if not set
+    NonFinite string
+    // JSONLargeNumber if not set, so integer columns stay numbers for the
+    // JS client and other existing readers of JSONWrite output, which would
+    // otherwise get strings for some values of a column. Set JSONLargeString
+    // where values beyond 2^53, eg. 64 bit ids, must reach a JavaScript
+    // reader unrounded; it then needs to handle the strings.
+    LargeIntegers string
+    // JSONObjects only, leave out keys of NULL values
+    OmitNulls bool
+    // JSONObjects only, write keys sorted by name instead of column order
+    SortKeys bool
+}
+
+// check option values, empty values are replaced with defaults
+func (opts *JSONOptions) check() error {
+    if opts.Format == "" {
+        opts.Format = JSONRows
+    }
+    if opts.NonFinite == "" {
+        opts.NonFinite = JSONNonFiniteNull
+    }
+    if opts.LargeIntegers == "" {
+        opts.LargeIntegers = JSONLargeNumber
+    }
+    switch opts.Format {
+        case JSONRows, JSONColumns, JSONObjects:
+        default:
+            return fmt.Errorf("JSONWrite unknown format %s", opts.Format)
+    }
+    switch opts.NonFinite {
+        case JSONNonFiniteNull, JSONNonFiniteString, JSONNonFiniteError:
+        default:
+            return fmt.Errorf("JSONWrite unknown NonFinite %s", opts.NonFinite)
+    }
+    switch opts.LargeIntegers {
+        case JSONLargeString, JSONLargeNumber:
+        default:
+            return fmt.Errorf("JSONWrite unknown LargeIntegers %s", opts.LargeIntegers)
+    }
+    return nil
+}
+
+// With JSONNonFiniteError check every float is finite so no partial
+// document is written
+func (t *Table) checkJSONFinite(opts JSONOptions) error {
+    if opts.NonFinite != JSONNonFiniteError {
+        return nil
+    }
+    hasFloat := false
+    for _, datatype := range t.ColumnTypes {
+        if datatype == FloatDatatype {
+            hasFloat = true
+        }
+    }
+    if !hasFloat {
+        return nil
+    }
+    row := make([]*interface{}, len(t.ColumnTypes))
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+    }
+    for i := 0; i < t.rowCount(); i++ {
+        err := t.readRow(i, row)
+        if err != nil {
+            return err
+        }
+        for j, v := range row {
+            if f, ok := (*v).(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+                return fmt.Errorf(
+                    "JSONWrite row %d column %s value %v not finite",
+                    i,
+                    t.ColumnNames[j],
+                    f,
+                )
+            }
+        }
+    }
+    return nil
+}
+
+// Write table as JSON in the format chosen by opts. Output is buffered, the
+// first write or row decoding error is returned.
+func (t *Table) JSONWriteOptions(w io.Writer, opts JSONOptions) error {
+    err := opts.check()
+    if err != nil {
+        return err
+    }
+    err = t.checkJSONFinite(opts)
+    if err != nil {
+        return err
+    }
+    bw := bufio.NewWriter(w)
+    err = t.jsonWrite(bw, opts)
+    if err != nil {
+        return err
+    }
+    return bw.Flush()
+}
+
+// Write table set as JSON object of table name to table, each table
+// written as by Table.JSONWriteOptions
+func (t TableSet) JSONWriteOptions(w io.Writer, opts JSONOptions) error {
+    err := opts.check()
+    if err != nil {
+        return err
+    }
+    names := t.Names()
+    for _, k := range names {
+        err = t[k].checkJSONFinite(opts)
+        if err != nil {
+            return err
+        }
+    }
+    bw := bufio.NewWriter(w)
+    err = bw.WriteByte('{')
+    if err != nil {
+        return err
+    }
+    for i, k := range names {
+        if i != 0 {
+            err = bw.WriteByte(',')
+            if err != nil {
+                return err
+            }
+        }
+        err = writeJSON(bw, k)
+        if err != nil {
+            return err
+        }
+        err = bw.WriteByte(':')
+        if err != nil {
+            return err
+        }
+        err = t[k].jsonWrite(bw, opts)
+        if err != nil {
+            return err
+        }
+    }
+    err = bw.WriteByte('}')
+    if err != nil {
+        return err
+    }
+    return bw.Flush()
+}
+
+func writeJSON(w *bufio.Writer, v interface{}) error {
+    js, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(js)
+    return err
+}
+
+// append JSON encoding of a table value, floats are written in the
+// shortest form that parses back to the same value
+func appendJSONValue(buf []byte, v interface{}, opts JSONOptions) ([]byte, error) {
+    switch v := v.(type) {
+        case nil:
+            return append(buf, "null"...), nil
+        case int64:
+            if v > maxSafeInteger || v < -maxSafeInteger {
+                if opts.LargeIntegers == JSONLargeString {
+                    buf = append(buf, '"')
+                    buf = strconv.AppendInt(buf, v, 10)
+                    return append(buf, '"'), nil
+                }
+            }
+            return strconv.AppendInt(buf, v, 10), nil
+        case float64:
+            if math.IsNaN(v) || math.IsInf(v, 0) {
+                switch opts.NonFinite {
+                    case JSONNonFiniteString:
+                        if math.IsNaN(v) {
+                            return append(buf, "\"NaN\""...), nil
+                        } else if v > 0 {
+                            return append(buf, "\"Infinity\""...), nil
+                        }
+                        return append(buf, "\"-Infinity\""...), nil
+                    case JSONNonFiniteError:
+                        return buf, fmt.Errorf("JSONWrite value %v not finite", v)
+                }
+                return append(buf, "null"...), nil
+            }
+            return strconv.AppendFloat(buf, v, 'g', -1, 64), nil
+    }
+    js, err := json.Marshal(v)
+    if err != nil {
+        return buf, err
+    }
+    return append(buf, js...), nil
+}
+
+// opts must have been checked
+func (t *Table) jsonWrite(w *bufio.Writer, opts JSONOptions) error {
+    if opts.Format == JSONObjects {
+        return t.jsonWriteObjects(w, opts)
+    }
+
+    _, err := w.WriteString("{\"ColumnNames\":")
+    if err != nil {
+        return err
+    }
+    err = writeJSON(w, t.ColumnNames)
+    if err != nil {
+        return err
+    }
+    _, err = w.WriteString(", \"ColumnTypes\":")
+    if err != nil {
+        return err
+    }
+    err = writeJSON(w, t.ColumnTypes)
+    if err != nil {
+        return err
+    }
+
+    if opts.Format == JSONColumns {
+        _, err = w.WriteString(", \"Columns\":[")
+        if err == nil {
+            err = t.jsonWriteColumns(w, opts)
+        }
+    } else {
+        _, err = w.WriteString(", \"Data\":[")
+        if err == nil {
+            err = t.jsonWriteRows(w, opts)
+        }
+    }
+    if err != nil {
+        return err
+    }
+    _, err = w.WriteString("]}")
+    return err
+}
+
+func (t *Table) jsonWriteRows(w *bufio.Writer, opts JSONOptions) error {
+    row := make([]*interface{}, len(t.ColumnTypes))
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+    }
+    var buf []byte
+    for i := 0; i < t.rowCount(); i++ {
+        err := t.readRow(i, row)
+        if err != nil {
+            return err
+        }
+        buf = buf[:0]
+        if i != 0 {
+            buf = append(buf, ',')
+        }
+        buf = append(buf, '[')
+        for j, v := range row {
+            if j != 0 {
+                buf = append(buf, ',')
+            }
+            buf, err = appendJSONValue(buf, *v, opts)
+            if err != nil {
+                return err
+            }
+        }
+        buf = append(buf, ']')
+        _, err = w.Write(buf)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// rows are decoded once, each column's values collected before writing
+func (t *Table) jsonWriteColumns(w *bufio.Writer, opts JSONOptions) error {
+    row := make([]*interface{}, len(t.ColumnTypes))
+    columns := make([][]byte, len(t.ColumnTypes))
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+        columns[i] = []byte{'['}
+    }
+    for i := 0; i < t.rowCount(); i++ {
+        err := t.readRow(i, row)
+        if err != nil {
+            return err
+        }
+        for j, v := range row {
+            if i != 0 {
+                columns[j] = append(columns[j], ',')
+            }
+            columns[j], err = appendJSONValue(columns[j], *v, opts)
+            if err != nil {
+                return err
+            }
+        }
+    }
+    for i, column := range columns {
+        if i != 0 {
+            err := w.WriteByte(',')
+            if err != nil {
+                return err
+            }
+        }
+        _, err := w.Write(append(column, ']'))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (t *Table) jsonWriteObjects(w *bufio.Writer, opts JSONOptions) error {
+    // "column": prefix of each value, in the order keys are written
+    order := make([]int, len(t.ColumnNames))
+    keys := make([][]byte, len(t.ColumnNames))
+    for i, name := range t.ColumnNames {
+        order[i] = i
+        js, err := json.Marshal(name)
+        if err != nil {
+            return err
+        }
+        keys[i] = append(js, ':')
+    }
+    if opts.SortKeys {
+        sort.Sort(columnOrder{order, t.ColumnNames})
+    }
+
+    row := make([]*interface{}, len(t.ColumnTypes))
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+    }
+    buf := []byte{'['}
+    for i := 0; i < t.rowCount(); i++ {
+        err := t.readRow(i, row)
+        if err != nil {
+            return err
+        }
+        if i != 0 {
+            buf = append(buf, ',')
+        }
+        buf = append(buf, '{')
+        first := true
+        for _, j := range order {
+            if *row[j] == nil && opts.OmitNulls {
+                continue
+            }
+            if !first {
+                buf = append(buf, ',')
+            }
+            first = false
+            buf = append(buf, keys[j]...)
+            buf, err = appendJSONValue(buf, *row[j], opts)
+            if err != nil {
+                return err
+            }
+        }
+        buf = append(buf, '}')
+        _, err = w.Write(buf)
+        if err != nil {
+            return err
+        }
+        buf = buf[:0]
+    }
+    buf = append(buf, ']')
+    _, err := w.Write(buf)
+    return err
+}
+
+// sorts column indexes by column name
+type columnOrder struct {
+    order []int
+    names []string
+}
+
+func (o columnOrder) Len() int {
+    return len(o.order)
+}
+
+func (o columnOrder) Less(i, j int) bool {
+    return o.names[o.order[i]] < o.names[o.order[j]]
+}
+
+func (o columnOrder) Swap(i, j int) {
+    o.order[i], o.order[j] = o.order[j], o.order[i]
+}
+
+type jsonTable struct {
+    ColumnNames []string
+    ColumnTypes []ColumnDatatype
+    Data [][]interface{}
+    Columns [][]interface{}
+}
+
+// Load table written by Table.JSONWrite, in the JSONRows or JSONColumns
+// format. Large integers and non finite floats written as strings are
+// read back as numbers.
+func LoadTableFromJSON(r io.Reader) (*Table, error) {
+    var js jsonTable
+    dec := json.NewDecoder(r)
+    dec.UseNumber()
+    err := dec.Decode(&js)
+    if err != nil {
+        return nil, fmt.Errorf("LoadTableFromJSON %s\n", err.Error())
+    }
+    return tableFromJSON(&js)
+}
+
+// Load table set written by TableSet.JSONWrite, see LoadTableFromJSON
+func LoadTableSetFromJSON(r io.Reader) (TableSet, error) {
+    var js map[string]*jsonTable
+    dec := json.NewDecoder(r)
+    dec.UseNumber()
+    err := dec.Decode(&js)
+    if err != nil {
+        return nil, fmt.Errorf("LoadTableSetFromJSON %s\n", err.Error())
+    }
+    ret := make(TableSet)
+    for name, table := range js {
+        if table == nil {
+            return nil, fmt.Errorf("LoadTableSetFromJSON table %s is null\n", name)
+        }
+        ret[name], err = tableFromJSON(table)
+        if err != nil {
+            return nil, fmt.Errorf("LoadTableSetFromJSON table %s: %s", name, err.Error())
+        }
+    }
+    return ret, nil
+}
+
+func tableFromJSON(js *jsonTable) (*Table, error) {
+    info := &Table{
+        ColumnNames : js.ColumnNames,
+        ColumnTypes : js.ColumnTypes,
+    }
+    if len(info.ColumnNames) != len(info.ColumnTypes) {
+        return nil, fmt.Errorf("LoadTableFromJSON %d column names, %d types\n",
+                               len(info.ColumnNames), len(info.ColumnTypes))
+    }
+    for _, datatype := range info.ColumnTypes {
+        if _, ok := mapDatatypeToSqlite[datatype]; !ok {
+            return nil, fmt.Errorf("LoadTableFromJSON unknown type %s\n", datatype)
+        }
+    }
+
+    // columns format is turned into rows
+    rows := js.Data
+    if js.Columns != nil {
+        if len(js.Columns) != len(info.ColumnNames) {
+            return nil, fmt.Errorf("LoadTableFromJSON %d columns, expected %d\n",
+                                   len(js.Columns), len(info.ColumnNames))
+        }
+        if len(js.Columns) > 0 {
+            rows = make([][]interface{}, len(js.Columns[0]))
+        }
+        for i := range rows {
+            rows[i] = make([]interface{}, len(js.Columns))
+            for j, column := range js.Columns {
+                if len(column) != len(rows) {
+                    return nil, fmt.Errorf("LoadTableFromJSON column %s length %d, expected %d\n",
+                                           info.ColumnNames[j], len(column), len(rows))
+                }
+                rows[i][j] = column[i]
+            }
+        }
+    }
+
+    info.initData()
+    for i, row := range rows {
+        if len(row) != len(info.ColumnTypes) {
+            return nil, fmt.Errorf("LoadTableFromJSON row %d has %d values, expected %d\n",
+                                   i, len(row), len(info.ColumnTypes))
+        }
+        for j, v := range row {
+            value, err := jsonTableValue(v, info.ColumnTypes[j])
+            if err != nil {
+                return nil, fmt.Errorf("LoadTableFromJSON row %d column %s: %s\n",
+                                       i, info.ColumnNames[j], err.Error())
+            }
+            row[j] = value
+        }
+        err := info.writeRow(row)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return info, nil
+}
+
+// convert decoded JSON value to value of datatype
+func jsonTableValue(v interface{}, datatype ColumnDatatype) (interface{}, error) {
+    if v == nil {
+        return nil, nil
+    }
+    switch datatype {
+        case IntegerDatatype:
+            switch v := v.(type) {
+                case json.Number:
+                    return strconv.ParseInt(string(v), 10, 64)
+                case string:
+                    return strconv.ParseInt(v, 10, 64)
+            }
+        case FloatDatatype:
+            switch v := v.(type) {
+                case json.Number:
+                    return strconv.ParseFloat(string(v), 64)
+                case string:
+                    switch v {
+                        case "NaN":
+                            return math.NaN(), nil
+                        case "Infinity":
+                            return math.Inf(1), nil
+                        case "-Infinity":
+                            return math.Inf(-1), nil
+                    }
+            }
+        case StringDatatype:
+            if s, ok := v.(string); ok {
+                return s, nil
+            }
+    }
+    return nil, fmt.Errorf("bad %s value %v", datatype, v)
+}
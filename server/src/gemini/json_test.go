@@ -0,0 +1,273 @@
+package gemini
+
+import (
+    "bytes"
+    "encoding/json"
+    "math"
+    "strings"
+    "testing"
+)
+
+var jsonFormatTests = []struct {
+    format string
+    expected string
+}{
+    {
+        JSONRows,
+        `{"ColumnNames":["name","age","height"], "ColumnTypes":["string","integer","float"], ` +
+        `"Data":[["tim",5,1.1],[null,-4,null],["lao",null,1.5],["",1099511627776,-0.25]]}`,
+    },
+    {
+        JSONColumns,
+        `{"ColumnNames":["name","age","height"], "ColumnTypes":["string","integer","float"], ` +
+        `"Columns":[["tim",null,"lao",""],[5,-4,null,1099511627776],[1.1,null,1.5,-0.25]]}`,
+    },
+}
+
+func TestJSONWriteFormats(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"name", "age", "height"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            IntegerDatatype,
+            FloatDatatype,
+        },
+    }
+    info.initData()
+    for _, row := range [][]interface{}{
+        {"tim", 5, 1.1},
+        {nil, -4, nil},
+        {"lao", nil, 1.5},
+        {"", 1 << 40, -0.25},
+    } {
+        fatalOnError(info.writeRow(row), t)
+    }
+    for _, test := range jsonFormatTests {
+        var buf bytes.Buffer
+        err := info.JSONWriteOptions(&buf, JSONOptions{Format: test.format})
+        fatalOnError(err, t)
+        if buf.String() != test.expected {
+            t.Errorf("%s: got\n%s\nexpected\n%s", test.format, buf.String(), test.expected)
+        }
+    }
+
+    var buf bytes.Buffer
+    fatalOnError(info.JSONWrite(&buf), t)
+    if buf.String() != jsonFormatTests[0].expected {
+        t.Errorf("default format %s", buf.String())
+    }
+
+    err := info.JSONWriteOptions(&buf, JSONOptions{Format: "xml"})
+    if err == nil {
+        t.Error("expected error for unknown format")
+    }
+}
+
+func TestTableSetJSONColumns(t *testing.T) {
+    empty := &Table{
+        ColumnNames : []string{"x", "y"},
+        ColumnTypes : []ColumnDatatype{IntegerDatatype, StringDatatype},
+    }
+    empty.initData()
+    people := &Table{
+        ColumnNames : []string{"name", "age"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, IntegerDatatype},
+    }
+    people.initData()
+    for _, row := range [][]interface{}{{"tim", 5}, {nil, 4}, {"lao", nil}} {
+        fatalOnError(people.writeRow(row), t)
+    }
+    tables := TableSet{"people" : people, "empty" : empty}
+
+    var buf bytes.Buffer
+    err := tables.JSONWriteOptions(&buf, JSONOptions{Format: JSONColumns})
+    fatalOnError(err, t)
+    var decoded map[string]struct {
+        ColumnNames []string
+        Columns [][]interface{}
+    }
+    fatalOnError(json.Unmarshal(buf.Bytes(), &decoded), t)
+    if len(decoded["empty"].Columns) != 2 || len(decoded["empty"].Columns[0]) != 0 {
+        t.Errorf("empty columns %v", decoded["empty"].Columns)
+    }
+    columns := decoded["people"].Columns
+    if len(columns) != 2 || columns[0][2] != "lao" || columns[1][2] != nil {
+        t.Errorf("people columns %v", columns)
+    }
+}
+
+// not a constant expression, which would be exactly 0.3
+var pointOne = 0.1
+
+var jsonNumericTests = []struct {
+    opts JSONOptions
+    expected string
+}{
+    {
+        JSONOptions{},
+        `[[0.30000000000000004,9007199254740991],[1e+21,9007199254740993],` +
+        `[null,-4611686018427387904],[null,null]]`,
+    },
+    {
+        JSONOptions{LargeIntegers: JSONLargeString},
+        `[[0.30000000000000004,9007199254740991],[1e+21,"9007199254740993"],` +
+        `[null,"-4611686018427387904"],[null,null]]`,
+    },
+    {
+        JSONOptions{NonFinite: JSONNonFiniteString, LargeIntegers: JSONLargeNumber},
+        `[[0.30000000000000004,9007199254740991],[1e+21,9007199254740993],` +
+        `["NaN",-4611686018427387904],["-Infinity",null]]`,
+    },
+}
+
+func TestJSONWriteNumbers(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"f", "n"},
+        ColumnTypes : []ColumnDatatype{FloatDatatype, IntegerDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{
+        {pointOne + 0.2, int64(1) << 53 - 1},
+        {1e21, int64(1) << 53 + 1},
+        {math.NaN(), -(int64(1) << 62)},
+        {math.Inf(-1), nil},
+    } {
+        fatalOnError(info.writeRow(row), t)
+    }
+    for _, test := range jsonNumericTests {
+        var buf bytes.Buffer
+        err := info.JSONWriteOptions(&buf, test.opts)
+        fatalOnError(err, t)
+        var decoded struct {
+            Data json.RawMessage
+        }
+        fatalOnError(json.Unmarshal(buf.Bytes(), &decoded), t)
+        if string(decoded.Data) != test.expected {
+            t.Errorf("%v: got %s expected %s", test.opts, decoded.Data, test.expected)
+        }
+
+        // same values in a table set and as columns
+        buf.Reset()
+        err = TableSet{"t" : info}.JSONWriteOptions(&buf, test.opts)
+        fatalOnError(err, t)
+        if !bytes.Contains(buf.Bytes(), decoded.Data) {
+            t.Errorf("%v: table set %s", test.opts, buf.Bytes())
+        }
+        // NDJSON rows as the data array
+        buf.Reset()
+        err = info.NDJSONWriteOptions(&buf, test.opts)
+        fatalOnError(err, t)
+        lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+        if rows := "[" + strings.Join(lines[1:], ",") + "]"; rows != string(decoded.Data) {
+            t.Errorf("%v: NDJSON rows %s", test.opts, rows)
+        }
+        buf.Reset()
+        test.opts.Format = JSONColumns
+        err = info.JSONWriteOptions(&buf, test.opts)
+        fatalOnError(err, t)
+        if !bytes.Contains(buf.Bytes(), []byte("1e+21")) {
+            t.Errorf("%v: columns %s", test.opts, buf.Bytes())
+        }
+    }
+
+    // shortest form still round trips
+    var buf bytes.Buffer
+    fatalOnError(info.JSONWrite(&buf), t)
+    var decoded struct {
+        Data [][]interface{}
+    }
+    fatalOnError(json.Unmarshal(buf.Bytes(), &decoded), t)
+    if decoded.Data[0][0] != pointOne + 0.2 {
+        t.Errorf("float decoded as %v", decoded.Data[0][0])
+    }
+}
+
+func TestJSONWriteNonFiniteError(t *testing.T) {
+    finite := &Table{
+        ColumnNames : []string{"f"},
+        ColumnTypes : []ColumnDatatype{FloatDatatype},
+    }
+    finite.initData()
+    fatalOnError(finite.writeRow([]interface{}{1.5}), t)
+    nan := &Table{
+        ColumnNames : []string{"f"},
+        ColumnTypes : []ColumnDatatype{FloatDatatype},
+    }
+    nan.initData()
+    fatalOnError(nan.writeRow([]interface{}{1.5}), t)
+    fatalOnError(nan.writeRow([]interface{}{math.NaN()}), t)
+
+    var w failingWriter
+    opts := JSONOptions{NonFinite: JSONNonFiniteError}
+    err := nan.JSONWriteOptions(&w, opts)
+    if err == nil || err == errFailingWriter {
+        t.Errorf("expected non finite error, got %v", err)
+    }
+    err = TableSet{"a" : finite, "b" : nan}.JSONWriteOptions(&w, opts)
+    if err == nil || err == errFailingWriter {
+        t.Errorf("expected table set non finite error, got %v", err)
+    }
+
+    err = finite.JSONWriteOptions(&w, JSONOptions{LargeIntegers: "float"})
+    if err == nil {
+        t.Error("expected error for unknown LargeIntegers")
+    }
+}
+
+var jsonObjectTests = []struct {
+    opts JSONOptions
+    expected string
+}{
+    {
+        JSONOptions{Format: JSONObjects},
+        `[{"name":"tim","age":5,"height":1.1},{"name":null,"age":-4,"height":null},` +
+        `{"name":"lao","age":null,"height":1.5},{"name":"","age":1099511627776,"height":-0.25}]`,
+    },
+    {
+        JSONOptions{Format: JSONObjects, OmitNulls: true, SortKeys: true},
+        `[{"age":5,"height":1.1,"name":"tim"},{"age":-4},` +
+        `{"height":1.5,"name":"lao"},{"age":1099511627776,"height":-0.25,"name":""}]`,
+    },
+}
+
+func TestJSONWriteObjects(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"name", "age", "height"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            IntegerDatatype,
+            FloatDatatype,
+        },
+    }
+    info.initData()
+    for _, row := range [][]interface{}{
+        {"tim", 5, 1.1},
+        {nil, -4, nil},
+        {"lao", nil, 1.5},
+        {"", 1 << 40, -0.25},
+    } {
+        fatalOnError(info.writeRow(row), t)
+    }
+    for _, test := range jsonObjectTests {
+        var buf bytes.Buffer
+        err := info.JSONWriteOptions(&buf, test.opts)
+        fatalOnError(err, t)
+        if buf.String() != test.expected {
+            t.Errorf("%v: got\n%s\nexpected\n%s", test.opts, buf.String(), test.expected)
+        }
+    }
+
+    empty := &Table{
+        ColumnNames : []string{"x"},
+        ColumnTypes : []ColumnDatatype{IntegerDatatype},
+    }
+    empty.initData()
+    var buf bytes.Buffer
+    tables := TableSet{"people" : info, "empty" : empty}
+    err := tables.JSONWriteOptions(&buf, jsonObjectTests[1].opts)
+    fatalOnError(err, t)
+    expected := `{"empty":[],"people":` + jsonObjectTests[1].expected + `}`
+    if buf.String() != expected {
+        t.Errorf("table set got\n%s\nexpected\n%s", buf.String(), expected)
+    }
+}
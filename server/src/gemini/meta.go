@@ -0,0 +1,181 @@
+package gemini
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+)
+
+// Name of the table PerformQueries adds to its TableSet describing how the
+// fact table's columns relate to the dimension tables, one row per fact
+// column in fact column order:
+//
+// fact_column:    column in the fact table
+// dimension:      dimension table the column's ids are rows of
+// key_column:     id column of the dimension table
+// unique_column:  column of the dimension table's unique values
+// extra_columns:  JSON array of the other dimension table columns
+// sort_expr:      sqlite expression dimension rows are sorted by
+// sort_direction: asc or desc
+//
+// Measure columns have an empty dimension and the other columns empty, with
+// extra_columns an empty array.
+const MetaTable = "meta"
+
+var metaColumnNames []string = []string{
+    "fact_column",
+    "dimension",
+    "key_column",
+    "unique_column",
+    "extra_columns",
+    "sort_expr",
+    "sort_direction",
+}
+
+// Relationship of a fact table column to its dimension table
+type FactColumn struct {
+    Column string
+    Dimension string
+    KeyColumn string
+    UniqueColumn string
+    ExtraColumns []string
+    SortExpr string
+    SortDirection string
+    // column holds source values rather than dimension ids
+    Measure bool
+}
+
+func metaTable(dimDefs map[string]*DimensionDefinition, measures []string) (*Table, error) {
+    info := &Table{
+        ColumnNames : metaColumnNames,
+        ColumnTypes : make([]ColumnDatatype, len(metaColumnNames)),
+    }
+    for i := range info.ColumnTypes {
+        info.ColumnTypes[i] = StringDatatype
+    }
+    info.initData()
+    for _, name := range orderedDimNames(dimDefs) {
+        dim := dimDefs[name]
+        extra := dim.ExtraColumns
+        if extra == nil {
+            extra = []string{}
+        }
+        js, err := json.Marshal(extra)
+        if err != nil {
+            return nil, err
+        }
+        err = info.writeRow([]interface{}{
+            dim.IndexColumn,
+            name,
+            dim.IndexColumn,
+            dim.UniqueColumn,
+            string(js),
+            dim.SortExpr,
+            strings.ToLower(dim.SortDirection),
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    for _, measure := range measures {
+        err := info.writeRow([]interface{}{measure, "", "", "", "[]", "", ""})
+        if err != nil {
+            return nil, err
+        }
+    }
+    return info, nil
+}
+
+// Fact columns and their dimension tables, from the MetaTable table. For
+// table sets without one the fact column "x_id" is taken to be the id
+// column of dimension table "xs" with unique column "x", other columns are
+// measures.
+func (t TableSet) FactColumns() ([]FactColumn, error) {
+    meta, ok := t[MetaTable]
+    if !ok {
+        return t.conventionFactColumns(), nil
+    }
+    if !stringsEqual(meta.ColumnNames, metaColumnNames) {
+        return nil, fmt.Errorf("FactColumns bad %s columns %v", MetaTable, meta.ColumnNames)
+    }
+
+    row := make([]*interface{}, len(meta.ColumnNames))
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+    }
+    columns := make([]FactColumn, meta.rowCount())
+    for i := range columns {
+        err := meta.readRow(i, row)
+        if err != nil {
+            return nil, err
+        }
+        values := make([]string, len(row))
+        for j, v := range row {
+            s, ok := (*v).(string)
+            if !ok {
+                return nil, fmt.Errorf("FactColumns %s row %d has NULL", MetaTable, i)
+            }
+            values[j] = s
+        }
+        c := &columns[i]
+        c.Column = values[0]
+        c.Dimension = values[1]
+        c.KeyColumn = values[2]
+        c.UniqueColumn = values[3]
+        err = json.Unmarshal([]byte(values[4]), &c.ExtraColumns)
+        if err != nil {
+            return nil, fmt.Errorf("FactColumns %s row %d: %s", MetaTable, i, err.Error())
+        }
+        c.SortExpr = values[5]
+        c.SortDirection = values[6]
+        c.Measure = c.Dimension == ""
+    }
+    return columns, nil
+}
+
+func (t TableSet) conventionFactColumns() []FactColumn {
+    fact, ok := t["fact"]
+    if !ok {
+        return nil
+    }
+    var columns []FactColumn
+    for _, column := range fact.ColumnNames {
+        if !strings.HasSuffix(column, "_id") {
+            columns = append(columns, FactColumn{
+                Column : column,
+                ExtraColumns : []string{},
+                Measure : true,
+            })
+            continue
+        }
+        unique := strings.TrimSuffix(column, "_id")
+        c := FactColumn{
+            Column : column,
+            Dimension : unique + "s",
+            KeyColumn : column,
+            UniqueColumn : unique,
+            ExtraColumns : []string{},
+        }
+        if dim, ok := t[c.Dimension]; ok {
+            for _, name := range dim.ColumnNames {
+                if name != c.KeyColumn && name != c.UniqueColumn {
+                    c.ExtraColumns = append(c.ExtraColumns, name)
+                }
+            }
+        }
+        columns = append(columns, c)
+    }
+    return columns
+}
+
+func stringsEqual(a, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
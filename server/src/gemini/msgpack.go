@@ -0,0 +1,402 @@
+package gemini
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+)
+
+// MessagePack encoding of tables, with the same structure as the JSON
+// output. A table is a map of "ColumnNames", "ColumnTypes" and "Data" where
+// Data is an array of row arrays, a table set is a map of name to table.
+// Integers use the smallest int/uint format, floats are float 64 and NULLs
+// are nil.
+
+const msgpackMaxDepth = 32
+
+type msgpackWriter struct {
+    w *bufio.Writer
+}
+
+func (m msgpackWriter) writeHeader(fixed byte, fixedMax int, codes [3]byte, n int) {
+    var b [5]byte
+    switch {
+        case n <= fixedMax:
+            m.w.WriteByte(fixed | byte(n))
+        case codes[0] != 0 && n <= math.MaxUint8:
+            m.w.Write([]byte{codes[0], byte(n)})
+        case n <= math.MaxUint16:
+            b[0] = codes[1]
+            binary.BigEndian.PutUint16(b[1:], uint16(n))
+            m.w.Write(b[:3])
+        default:
+            b[0] = codes[2]
+            binary.BigEndian.PutUint32(b[1:], uint32(n))
+            m.w.Write(b[:5])
+    }
+}
+
+func (m msgpackWriter) writeString(s string) {
+    m.writeHeader(0xa0, 31, [3]byte{0xd9, 0xda, 0xdb}, len(s))
+    m.w.WriteString(s)
+}
+
+func (m msgpackWriter) writeArrayHeader(n int) {
+    m.writeHeader(0x90, 15, [3]byte{0, 0xdc, 0xdd}, n)
+}
+
+func (m msgpackWriter) writeMapHeader(n int) {
+    m.writeHeader(0x80, 15, [3]byte{0, 0xde, 0xdf}, n)
+}
+
+func (m msgpackWriter) writeInt(v int64) {
+    var b [9]byte
+    switch {
+        case v >= 0 && v <= 0x7f:
+            m.w.WriteByte(byte(v))
+        case v < 0 && v >= -32:
+            m.w.WriteByte(byte(v))
+        case v >= math.MinInt8 && v <= math.MaxInt8:
+            m.w.Write([]byte{0xd0, byte(v)})
+        case v >= 0 && v <= math.MaxUint8:
+            m.w.Write([]byte{0xcc, byte(v)})
+        case v >= math.MinInt16 && v <= math.MaxInt16:
+            b[0] = 0xd1
+            binary.BigEndian.PutUint16(b[1:], uint16(v))
+            m.w.Write(b[:3])
+        case v >= 0 && v <= math.MaxUint16:
+            b[0] = 0xcd
+            binary.BigEndian.PutUint16(b[1:], uint16(v))
+            m.w.Write(b[:3])
+        case v >= math.MinInt32 && v <= math.MaxInt32:
+            b[0] = 0xd2
+            binary.BigEndian.PutUint32(b[1:], uint32(v))
+            m.w.Write(b[:5])
+        case v >= 0 && v <= math.MaxUint32:
+            b[0] = 0xce
+            binary.BigEndian.PutUint32(b[1:], uint32(v))
+            m.w.Write(b[:5])
+        default:
+            b[0] = 0xd3
+            binary.BigEndian.PutUint64(b[1:], uint64(v))
+            m.w.Write(b[:9])
+    }
+}
+
+func (m msgpackWriter) writeFloat(v float64) {
+    var b [9]byte
+    b[0] = 0xcb
+    binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+    m.w.Write(b[:9])
+}
+
+func (m msgpackWriter) writeTable(t *Table) error {
+    m.writeMapHeader(3)
+    m.writeString("ColumnNames")
+    m.writeArrayHeader(len(t.ColumnNames))
+    for _, name := range t.ColumnNames {
+        m.writeString(name)
+    }
+    m.writeString("ColumnTypes")
+    m.writeArrayHeader(len(t.ColumnTypes))
+    for _, datatype := range t.ColumnTypes {
+        m.writeString(string(datatype))
+    }
+    m.writeString("Data")
+    m.writeArrayHeader(t.rowCount())
+    row := make([]*interface{}, len(t.ColumnTypes))
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+    }
+    for i := 0; i < t.rowCount(); i++ {
+        err := t.readRow(i, row)
+        if err != nil {
+            return err
+        }
+        m.writeArrayHeader(len(row))
+        for _, v := range row {
+            switch value := (*v).(type) {
+                case nil:
+                    m.w.WriteByte(0xc0)
+                case int64:
+                    m.writeInt(value)
+                case float64:
+                    m.writeFloat(value)
+                case string:
+                    m.writeString(value)
+            }
+        }
+    }
+    return nil
+}
+
+// Write table as MessagePack
+func (t *Table) MsgpackWrite(w io.Writer) error {
+    m := msgpackWriter{bufio.NewWriter(w)}
+    err := m.writeTable(t)
+    if err != nil {
+        return err
+    }
+    return m.w.Flush()
+}
+
+// Write table set as MessagePack map of table name to table
+func (t TableSet) MsgpackWrite(w io.Writer) error {
+    m := msgpackWriter{bufio.NewWriter(w)}
+    m.writeMapHeader(len(t))
+    for _, k := range t.Names() {
+        m.writeString(k)
+        err := m.writeTable(t[k])
+        if err != nil {
+            return err
+        }
+    }
+    return m.w.Flush()
+}
+
+type msgpackReader struct {
+    r *bufio.Reader
+}
+
+// read n bytes, growing the buffer as data arrives rather than trusting n
+func (m msgpackReader) readN(n int) ([]byte, error) {
+    var buf bytes.Buffer
+    _, err := io.CopyN(&buf, m.r, int64(n))
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    return buf.Bytes(), err
+}
+
+func (m msgpackReader) readUint(size int) (uint64, error) {
+    b, err := m.readN(size)
+    if err != nil {
+        return 0, err
+    }
+    var v uint64
+    for _, c := range b {
+        v = v << 8 | uint64(c)
+    }
+    return v, nil
+}
+
+// Read value as nil, bool, int64, uint64 (only if too big for int64),
+// float64, string, []byte, []interface{} or map[string]interface{}
+func (m msgpackReader) readValue(depth int) (interface{}, error) {
+    if depth > msgpackMaxDepth {
+        return nil, errors.New("msgpack nested too deeply")
+    }
+    c, err := m.r.ReadByte()
+    if err != nil {
+        return nil, err
+    }
+
+    switch {
+        case c <= 0x7f:
+            return int64(c), nil
+        case c >= 0xe0:
+            return int64(int8(c)), nil
+        case c & 0xe0 == 0xa0:
+            b, err := m.readN(int(c & 0x1f))
+            return string(b), err
+        case c & 0xf0 == 0x90:
+            return m.readArray(int(c & 0x0f), depth)
+        case c & 0xf0 == 0x80:
+            return m.readMap(int(c & 0x0f), depth)
+    }
+
+    switch c {
+        case 0xc0:
+            return nil, nil
+        case 0xc2:
+            return false, nil
+        case 0xc3:
+            return true, nil
+        case 0xcc, 0xcd, 0xce, 0xcf:
+            v, err := m.readUint(1 << (c - 0xcc))
+            if err != nil {
+                return nil, err
+            }
+            if v > math.MaxInt64 {
+                return v, nil
+            }
+            return int64(v), nil
+        case 0xd0, 0xd1, 0xd2, 0xd3:
+            size := uint(1 << (c - 0xd0))
+            v, err := m.readUint(int(size))
+            if err != nil {
+                return nil, err
+            }
+            // sign extend
+            shift := 64 - 8 * size
+            return int64(v << shift) >> shift, nil
+        case 0xca:
+            v, err := m.readUint(4)
+            return widenFloat32(math.Float32frombits(uint32(v))), err
+        case 0xcb:
+            v, err := m.readUint(8)
+            return math.Float64frombits(v), err
+        case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+            var size int
+            if c >= 0xd9 {
+                size = 1 << (c - 0xd9)
+            } else {
+                size = 1 << (c - 0xc4)
+            }
+            n, err := m.readUint(size)
+            if err != nil {
+                return nil, err
+            }
+            b, err := m.readN(int(n))
+            if c >= 0xd9 {
+                return string(b), err
+            }
+            return b, err
+        case 0xdc, 0xdd:
+            n, err := m.readUint(2 << (c - 0xdc))
+            if err != nil {
+                return nil, err
+            }
+            return m.readArray(int(n), depth)
+        case 0xde, 0xdf:
+            n, err := m.readUint(2 << (c - 0xde))
+            if err != nil {
+                return nil, err
+            }
+            return m.readMap(int(n), depth)
+    }
+    return nil, fmt.Errorf("msgpack unsupported format 0x%02x", c)
+}
+
+func (m msgpackReader) readArray(n int, depth int) ([]interface{}, error) {
+    // don't trust n for allocation
+    a := make([]interface{}, 0)
+    for i := 0; i < n; i++ {
+        v, err := m.readValue(depth + 1)
+        if err != nil {
+            return nil, err
+        }
+        a = append(a, v)
+    }
+    return a, nil
+}
+
+func (m msgpackReader) readMap(n int, depth int) (map[string]interface{}, error) {
+    ret := make(map[string]interface{})
+    for i := 0; i < n; i++ {
+        k, err := m.readValue(depth + 1)
+        if err != nil {
+            return nil, err
+        }
+        key, ok := k.(string)
+        if !ok {
+            return nil, errors.New("msgpack map key is not a string")
+        }
+        ret[key], err = m.readValue(depth + 1)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return ret, nil
+}
+
+// Load table from MessagePack written by Table.MsgpackWrite
+func LoadTableFromMsgpack(r io.Reader) (*Table, error) {
+    v, err := msgpackReader{bufio.NewReader(r)}.readValue(0)
+    if err != nil {
+        return nil, err
+    }
+    return tableFromMsgpack(v)
+}
+
+// Load table set from MessagePack written by TableSet.MsgpackWrite
+func LoadTableSetFromMsgpack(r io.Reader) (TableSet, error) {
+    v, err := msgpackReader{bufio.NewReader(r)}.readValue(0)
+    if err != nil {
+        return nil, err
+    }
+    m, ok := v.(map[string]interface{})
+    if !ok {
+        return nil, errors.New("LoadTableSetFromMsgpack expected map of tables")
+    }
+    ret := make(TableSet)
+    for k, v := range m {
+        ret[k], err = tableFromMsgpack(v)
+        if err != nil {
+            return nil, fmt.Errorf("LoadTableSetFromMsgpack table %s: %s", k, err.Error())
+        }
+    }
+    return ret, nil
+}
+
+func tableFromMsgpack(v interface{}) (*Table, error) {
+    m, ok := v.(map[string]interface{})
+    if !ok {
+        return nil, errors.New("LoadTableFromMsgpack expected table map")
+    }
+    names, ok1 := m["ColumnNames"].([]interface{})
+    types, ok2 := m["ColumnTypes"].([]interface{})
+    data, ok3 := m["Data"].([]interface{})
+    if !ok1 || !ok2 || !ok3 || len(names) != len(types) {
+        return nil, errors.New("LoadTableFromMsgpack bad table map")
+    }
+
+    var info Table
+    info.ColumnNames = make([]string, len(names))
+    info.ColumnTypes = make([]ColumnDatatype, len(types))
+    for i := 0; i < len(names); i++ {
+        name, ok := names[i].(string)
+        datatype, _ := types[i].(string)
+        if _, known := mapDatatypeToSqlite[ColumnDatatype(datatype)]; !ok || !known {
+            return nil, errors.New("LoadTableFromMsgpack bad column")
+        }
+        info.ColumnNames[i] = name
+        info.ColumnTypes[i] = ColumnDatatype(datatype)
+    }
+
+    info.initData()
+    values := make([]interface{}, len(names))
+    for i, r := range data {
+        row, ok := r.([]interface{})
+        if !ok || len(row) != len(names) {
+            return nil, fmt.Errorf("LoadTableFromMsgpack bad row %d", i)
+        }
+        for j, value := range row {
+            values[j] = value
+            if value == nil {
+                continue
+            }
+            switch info.ColumnTypes[j] {
+                case IntegerDatatype:
+                    _, ok = value.(int64)
+                case FloatDatatype:
+                    if n, isInt := value.(int64); isInt {
+                        values[j] = float64(n)
+                    }
+                    _, ok = values[j].(float64)
+                case StringDatatype:
+                    if b, isBin := value.([]byte); isBin {
+                        values[j] = string(b)
+                    }
+                    _, ok = values[j].(string)
+            }
+            if !ok {
+                return nil, fmt.Errorf(
+                    "LoadTableFromMsgpack row %d column %s bad value %v",
+                    i,
+                    info.ColumnNames[j],
+                    value,
+                )
+            }
+        }
+        err := info.writeRow(values)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return &info, nil
+}
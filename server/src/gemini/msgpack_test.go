@@ -0,0 +1,112 @@
+package gemini
+
+import (
+    "testing"
+    "bytes"
+    "reflect"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"stop_name", "arrivals", "lat"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            IntegerDatatype,
+            FloatDatatype,
+        },
+    }
+    info.initData()
+    for _, row := range [][]interface{}{
+        {"Courtenay Place", 120, -41.2935},
+        {nil, -3, nil},
+        {"Kilbirnie", nil, -41.3169},
+        {"", 1 << 40, 0.5},
+    } {
+        fatalOnError(info.writeRow(row), t)
+    }
+    var buf bytes.Buffer
+    err := TableSet{"people" : info}.MsgpackWrite(&buf)
+    fatalOnError(err, t)
+
+    var js bytes.Buffer
+    err = TableSet{"people" : info}.JSONWrite(&js)
+    fatalOnError(err, t)
+    if buf.Len() >= js.Len() {
+        t.Errorf("msgpack %d bytes not smaller than json %d", buf.Len(), js.Len())
+    }
+
+    tables, err := LoadTableSetFromMsgpack(&buf)
+    fatalOnError(err, t)
+    loaded := tables["people"]
+    if loaded == nil || !reflect.DeepEqual(loaded.ColumnTypes, info.ColumnTypes) {
+        t.Fatalf("loaded %v", tables)
+    }
+    expected, err := tableRows(info)
+    fatalOnError(err, t)
+    rows, err := tableRows(loaded)
+    fatalOnError(err, t)
+    if !reflect.DeepEqual(rows, expected) {
+        t.Errorf("rows %v expected %v", rows, expected)
+    }
+}
+
+var msgpackIntTests = []struct {
+    value int64
+    encoded []byte
+}{
+    {5, []byte{0x05}},
+    {-4, []byte{0xfc}},
+    {-100, []byte{0xd0, 0x9c}},
+    {200, []byte{0xcc, 0xc8}},
+    {-1000, []byte{0xd1, 0xfc, 0x18}},
+    {60000, []byte{0xcd, 0xea, 0x60}},
+    {1 << 40, []byte{0xd3, 0, 0, 1, 0, 0, 0, 0, 0}},
+}
+
+func TestMsgpackIntegers(t *testing.T) {
+    for _, test := range msgpackIntTests {
+        info := &Table{
+            ColumnNames : []string{"x"},
+            ColumnTypes : []ColumnDatatype{IntegerDatatype},
+        }
+        info.initData()
+        fatalOnError(info.writeRow([]interface{}{test.value}), t)
+        var buf bytes.Buffer
+        fatalOnError(info.MsgpackWrite(&buf), t)
+        encoded := buf.Bytes()
+        row := encoded[len(encoded) - len(test.encoded):]
+        if !bytes.Equal(row, test.encoded) {
+            t.Errorf("%d encoded as % x expected % x", test.value, row, test.encoded)
+        }
+
+        loaded, err := LoadTableFromMsgpack(&buf)
+        fatalOnError(err, t)
+        rows, err := tableRows(loaded)
+        fatalOnError(err, t)
+        if rows[0][0] != test.value {
+            t.Errorf("%d decoded as %v", test.value, rows[0][0])
+        }
+    }
+}
+
+func TestMsgpackMalformed(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"stop_name", "arrivals"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, IntegerDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"Courtenay Place", 120}, {"Kilbirnie", 80}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    var buf bytes.Buffer
+    fatalOnError(info.MsgpackWrite(&buf), t)
+    data := buf.Bytes()
+    _, err := LoadTableFromMsgpack(bytes.NewReader(data[:len(data) - 3]))
+    if err == nil {
+        t.Error("expected error for truncated data")
+    }
+    _, err = LoadTableFromMsgpack(bytes.NewReader([]byte{0xdb, 0xff, 0xff, 0xff, 0xff}))
+    if err == nil {
+        t.Error("expected error for huge string")
+    }
+}
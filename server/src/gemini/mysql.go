@@ -0,0 +1,419 @@
+package gemini
+
+import (
+    "github.com/timob/GoMySQL/src/mysql"
+    "fmt"
+    "errors"
+    "math"
+    "strconv"
+    "unicode/utf8"
+)
+
+// Mapping of MySQL field types to table column datatypes.
+//
+// integer: TINY, SHORT, INT24, LONG, LONGLONG, YEAR, BIT
+//          (unsigned values above 2^63-1 are an error, BIT is read as a
+//          big endian number)
+// float:   FLOAT, DOUBLE
+// string:  DECIMAL, NEWDECIMAL (kept as text so no precision is lost)
+//          VARCHAR, VAR_STRING, STRING, ENUM, SET
+//          TINY_BLOB, BLOB, MEDIUM_BLOB, LONG_BLOB (TEXT and BLOB columns)
+//          GEOMETRY (raw bytes)
+//          DATE, NEWDATE, TIME, DATETIME, TIMESTAMP (MySQL text format,
+//          which sorts chronologically)
+//          NULL (column only ever contains nulls)
+var mapMySQLToDatatype map[mysql.FieldType]ColumnDatatype = map[mysql.FieldType]ColumnDatatype{
+    mysql.FIELD_TYPE_TINY : IntegerDatatype,
+    mysql.FIELD_TYPE_SHORT : IntegerDatatype,
+    mysql.FIELD_TYPE_INT24 : IntegerDatatype,
+    mysql.FIELD_TYPE_LONG : IntegerDatatype,
+    mysql.FIELD_TYPE_LONGLONG : IntegerDatatype,
+    mysql.FIELD_TYPE_YEAR : IntegerDatatype,
+    mysql.FIELD_TYPE_BIT : IntegerDatatype,
+    mysql.FIELD_TYPE_FLOAT : FloatDatatype,
+    mysql.FIELD_TYPE_DOUBLE : FloatDatatype,
+    mysql.FIELD_TYPE_DECIMAL : StringDatatype,
+    mysql.FIELD_TYPE_NEWDECIMAL : StringDatatype,
+    mysql.FIELD_TYPE_VARCHAR : StringDatatype,
+    mysql.FIELD_TYPE_VAR_STRING : StringDatatype,
+    mysql.FIELD_TYPE_STRING : StringDatatype,
+    mysql.FIELD_TYPE_ENUM : StringDatatype,
+    mysql.FIELD_TYPE_SET : StringDatatype,
+    mysql.FIELD_TYPE_TINY_BLOB : StringDatatype,
+    mysql.FIELD_TYPE_BLOB : StringDatatype,
+    mysql.FIELD_TYPE_MEDIUM_BLOB : StringDatatype,
+    mysql.FIELD_TYPE_LONG_BLOB : StringDatatype,
+    mysql.FIELD_TYPE_GEOMETRY : StringDatatype,
+    mysql.FIELD_TYPE_DATE : StringDatatype,
+    mysql.FIELD_TYPE_NEWDATE : StringDatatype,
+    mysql.FIELD_TYPE_TIME : StringDatatype,
+    mysql.FIELD_TYPE_DATETIME : StringDatatype,
+    mysql.FIELD_TYPE_TIMESTAMP : StringDatatype,
+    mysql.FIELD_TYPE_NULL : StringDatatype,
+}
+
+// MySQL field types holding character data that is decoded using the
+// connection charset, unless the field has the binary flag set
+var mysqlTextTypes map[mysql.FieldType]bool = map[mysql.FieldType]bool{
+    mysql.FIELD_TYPE_VARCHAR : true,
+    mysql.FIELD_TYPE_VAR_STRING : true,
+    mysql.FIELD_TYPE_STRING : true,
+    mysql.FIELD_TYPE_ENUM : true,
+    mysql.FIELD_TYPE_SET : true,
+    mysql.FIELD_TYPE_TINY_BLOB : true,
+    mysql.FIELD_TYPE_BLOB : true,
+    mysql.FIELD_TYPE_MEDIUM_BLOB : true,
+    mysql.FIELD_TYPE_LONG_BLOB : true,
+}
+
+// Connection charsets understood by LoadTableFromMySQLCharset
+const (
+    MySQLCharsetUtf8 = "utf8"
+    MySQLCharsetUtf8mb4 = "utf8mb4"
+    MySQLCharsetLatin1 = "latin1"
+    MySQLCharsetAscii = "ascii"
+    MySQLCharsetBinary = "binary"
+)
+
+// part of *mysql.Result used to load a table, lets tests use a fake result
+type mysqlResult interface {
+    FetchFields() []*mysql.Field
+    FetchRow() mysql.Row
+}
+
+// Load table from MySQL result, text is expected to be utf8
+func LoadTableFromMySQL(result *mysql.Result) (*Table, error) {
+    return loadTableFromMySQLResult(result, MySQLCharsetUtf8)
+}
+
+// Load table from MySQL result, decoding text fields from the given
+// connection charset to utf8
+func LoadTableFromMySQLCharset(result *mysql.Result, charset string) (*Table, error) {
+    return loadTableFromMySQLResult(result, charset)
+}
+
+func checkMySQLCharset(charset string) error {
+    switch charset {
+        case MySQLCharsetUtf8, MySQLCharsetUtf8mb4, MySQLCharsetLatin1,
+             MySQLCharsetAscii, MySQLCharsetBinary:
+            return nil
+    }
+    return fmt.Errorf("LoadTableFromMySQL unknown charset %s\n", charset)
+}
+
+func loadTableFromMySQLResult(result mysqlResult, charset string) (*Table, error) {
+    var info Table
+
+    err := checkMySQLCharset(charset)
+    if err != nil {
+        return nil, err
+    }
+
+    fields := result.FetchFields()
+    info.ColumnNames = make([]string, len(fields))
+    info.ColumnTypes = make([]ColumnDatatype, len(fields))
+    for i := 0; i < len(fields); i++ {
+        info.ColumnNames[i] = fields[i].Name
+        datatype, ok := mapMySQLToDatatype[fields[i].Type]
+        if !ok {
+            return nil, errors.New(
+                fmt.Sprintf(
+                    "LoadTableFromMySQL unkown type %v\n",
+                    fields[i].Type,
+                ),
+            )
+        }
+        info.ColumnTypes[i] = datatype
+    }
+
+    info.initData()
+
+    values := make([]interface{}, len(fields))
+    for i := 0;;i++ {
+        row := result.FetchRow()
+        if row == nil {
+            break
+        }
+        for j := 0; j < len(fields); j++ {
+            value, err := convertMySQLValue(fields[j], row[j], charset)
+            if err != nil {
+                return nil, fmt.Errorf(
+                    "LoadTableFromMySQL row %d column %s: %s\n",
+                    i,
+                    fields[j].Name,
+                    err.Error(),
+                )
+            }
+            values[j] = value
+        }
+        err := info.writeRow(values)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return &info, nil
+}
+
+// Convert value returned by GoMySQL to int64, float64, string or nil
+// according to mapMySQLToDatatype
+func convertMySQLValue(field *mysql.Field, value interface{},
+                       charset string) (interface{}, error) {
+    if value == nil || field.Type == mysql.FIELD_TYPE_NULL {
+        return nil, nil
+    }
+
+    switch mapMySQLToDatatype[field.Type] {
+        case IntegerDatatype:
+            return mysqlInteger(field, value)
+        case FloatDatatype:
+            return mysqlFloat(value)
+    }
+
+    var raw []byte
+    switch v := value.(type) {
+        case string:
+            raw = []byte(v)
+        case []byte:
+            raw = v
+        case fmt.Stringer:
+            return v.String(), nil
+        default:
+            return fmt.Sprint(v), nil
+    }
+
+    if !mysqlTextTypes[field.Type] || field.Flags & mysql.FLAG_BINARY != 0 {
+        return string(raw), nil
+    }
+    return decodeMySQLText(raw, charset)
+}
+
+func mysqlInteger(field *mysql.Field, value interface{}) (int64, error) {
+    unsigned := field.Flags & mysql.FLAG_UNSIGNED != 0
+    switch v := value.(type) {
+        case int:
+            return int64(v), nil
+        case int8:
+            return int64(v), nil
+        case int16:
+            return int64(v), nil
+        case int32:
+            return int64(v), nil
+        case int64:
+            return v, nil
+        case uint8:
+            return int64(v), nil
+        case uint16:
+            return int64(v), nil
+        case uint32:
+            return int64(v), nil
+        case uint:
+            return checkedUint64(uint64(v))
+        case uint64:
+            return checkedUint64(v)
+        case []byte:
+            if field.Type == mysql.FIELD_TYPE_BIT {
+                return bitValue(v)
+            }
+            return parseMySQLInteger(string(v), unsigned)
+        case string:
+            if field.Type == mysql.FIELD_TYPE_BIT {
+                return bitValue([]byte(v))
+            }
+            return parseMySQLInteger(v, unsigned)
+    }
+    return parseMySQLInteger(fmt.Sprint(value), unsigned)
+}
+
+func checkedUint64(v uint64) (int64, error) {
+    if v > math.MaxInt64 {
+        return 0, fmt.Errorf("unsigned value %d overflows integer", v)
+    }
+    return int64(v), nil
+}
+
+func parseMySQLInteger(s string, unsigned bool) (int64, error) {
+    if unsigned {
+        v, err := strconv.ParseUint(s, 10, 64)
+        if err != nil {
+            return 0, err
+        }
+        return checkedUint64(v)
+    }
+    return strconv.ParseInt(s, 10, 64)
+}
+
+// BIT(n) values are sent as big endian bytes
+func bitValue(b []byte) (int64, error) {
+    if len(b) > 8 {
+        return 0, fmt.Errorf("bit value of %d bytes overflows integer", len(b))
+    }
+    var v uint64
+    for _, c := range b {
+        v = v << 8 | uint64(c)
+    }
+    return checkedUint64(v)
+}
+
+func mysqlFloat(value interface{}) (float64, error) {
+    switch v := value.(type) {
+        case float64:
+            return v, nil
+        case float32:
+            return widenFloat32(v), nil
+        case []byte:
+            return strconv.ParseFloat(string(v), 64)
+        case string:
+            return strconv.ParseFloat(v, 64)
+    }
+    return strconv.ParseFloat(fmt.Sprint(value), 64)
+}
+
+// cp1252 characters of bytes 0x80 to 0x9f, MySQL keeps the 5 bytes cp1252
+// leaves undefined as the matching control characters
+var cp1252Runes = [32]rune{
+    0x20ac, 0x0081, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+    0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008d, 0x017d, 0x008f,
+    0x0090, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+    0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x009d, 0x017e, 0x0178,
+}
+
+func decodeMySQLText(raw []byte, charset string) (string, error) {
+    switch charset {
+        case MySQLCharsetLatin1:
+            // MySQL's latin1 is cp1252, bytes other than 0x80 to 0x9f are
+            // the first 256 unicode code points
+            runes := make([]rune, len(raw))
+            for i, c := range raw {
+                if c >= 0x80 && c <= 0x9f {
+                    runes[i] = cp1252Runes[c - 0x80]
+                } else {
+                    runes[i] = rune(c)
+                }
+            }
+            return string(runes), nil
+        case MySQLCharsetAscii:
+            for _, c := range raw {
+                if c >= utf8.RuneSelf {
+                    return "", fmt.Errorf("invalid ascii byte 0x%02x", c)
+                }
+            }
+        case MySQLCharsetUtf8, MySQLCharsetUtf8mb4:
+            if !utf8.Valid(raw) {
+                return "", errors.New("invalid utf8 text")
+            }
+    }
+    return string(raw), nil
+}
+
+// part of *mysql.Client used to read multiple result sets
+type mysqlConn interface {
+    Query(sql string) error
+    storeResult() (mysqlResult, error)
+    FreeResult() error
+    MoreResults() bool
+    NextResult() (bool, error)
+}
+
+// storeResult error for a statement without a result set
+var errNoResultSet = errors.New("no result set")
+
+type mysqlClientConn struct {
+    *mysql.Client
+}
+
+func (c mysqlClientConn) storeResult() (mysqlResult, error) {
+    result, err := c.StoreResult()
+    if e, ok := err.(*mysql.ClientError); ok && e.Errno == mysql.CR_NO_RESULT_SET {
+        return nil, errNoResultSet
+    }
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+// Execute query, a multi-statement query or CALL of a stored procedure, and
+// load every result set it returns into a TableSet. Result set i is named
+// names[i], result sets without a name are named "result<i>". Statements
+// that do not return a result set (eg. the status result ending a CALL) are
+// skipped and do not use a name.
+func LoadTableSetFromMySQL(db *mysql.Client, query string,
+                           names ...string) (TableSet, error) {
+    return loadTableSetFromMySQLConn(mysqlClientConn{db}, query, names, MySQLCharsetUtf8)
+}
+
+// Load table set from MySQL query, decoding text fields from the given
+// connection charset to utf8
+func LoadTableSetFromMySQLCharset(db *mysql.Client, charset, query string,
+                                  names ...string) (TableSet, error) {
+    return loadTableSetFromMySQLConn(mysqlClientConn{db}, query, names, charset)
+}
+
+func loadTableSetFromMySQLConn(db mysqlConn, query string, names []string,
+                               charset string) (TableSet, error) {
+    // before the query, so results are never left unread
+    err := checkMySQLCharset(charset)
+    if err != nil {
+        return nil, err
+    }
+    err = db.Query(query)
+    if err != nil {
+        return nil, err
+    }
+
+    ret := make(TableSet)
+    count := 0
+    for {
+        result, err := db.storeResult()
+        if err != nil && err != errNoResultSet {
+            return nil, err
+        }
+        if err == nil {
+            var name string
+            if count < len(names) {
+                name = names[count]
+            } else {
+                name = fmt.Sprintf("result%d", count)
+            }
+            if _, ok := ret[name]; ok {
+                return nil, fmt.Errorf(
+                    "LoadTableSetFromMySQL duplicate table name %s\n",
+                    name,
+                )
+            }
+
+            ret[name], err = loadTableFromMySQLResult(result, charset)
+            if err != nil {
+                return nil, err
+            }
+            count++
+
+            err = db.FreeResult()
+            if err != nil {
+                return nil, err
+            }
+        }
+
+        if !db.MoreResults() {
+            break
+        }
+        more, err := db.NextResult()
+        if err != nil {
+            return nil, err
+        }
+        if !more {
+            break
+        }
+    }
+
+    if count < len(names) {
+        return nil, fmt.Errorf(
+            "LoadTableSetFromMySQL got %d result sets, expected %d\n",
+            count,
+            len(names),
+        )
+    }
+
+    return ret, nil
+}
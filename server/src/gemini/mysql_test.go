@@ -0,0 +1,271 @@
+package gemini
+
+import (
+    "github.com/timob/GoMySQL/src/mysql"
+    "testing"
+    "reflect"
+    "errors"
+)
+
+type fakeMySQLResult struct {
+    fields []*mysql.Field
+    rows []mysql.Row
+}
+
+func (r *fakeMySQLResult) FetchFields() []*mysql.Field {
+    return r.fields
+}
+
+func (r *fakeMySQLResult) FetchRow() mysql.Row {
+    if len(r.rows) == 0 {
+        return nil
+    }
+    row := r.rows[0]
+    r.rows = r.rows[1:]
+    return row
+}
+
+var mysqlTypeTests = []struct {
+    field mysql.Field
+    value interface{}
+    datatype ColumnDatatype
+    expected interface{}
+}{
+    {mysql.Field{Type: mysql.FIELD_TYPE_TINY}, int8(-3), IntegerDatatype, int64(-3)},
+    {mysql.Field{Type: mysql.FIELD_TYPE_SHORT}, int16(300), IntegerDatatype, int64(300)},
+    {mysql.Field{Type: mysql.FIELD_TYPE_INT24}, int32(70000), IntegerDatatype, int64(70000)},
+    {mysql.Field{Type: mysql.FIELD_TYPE_LONG}, int32(-5), IntegerDatatype, int64(-5)},
+    {mysql.Field{Type: mysql.FIELD_TYPE_LONGLONG}, int64(1 << 40), IntegerDatatype, int64(1 << 40)},
+    {mysql.Field{Type: mysql.FIELD_TYPE_LONGLONG, Flags: mysql.FLAG_UNSIGNED}, uint64(1 << 62), IntegerDatatype, int64(1 << 62)},
+    {mysql.Field{Type: mysql.FIELD_TYPE_LONGLONG, Flags: mysql.FLAG_UNSIGNED}, "4611686018427387904", IntegerDatatype, int64(1 << 62)},
+    {mysql.Field{Type: mysql.FIELD_TYPE_YEAR}, int16(2012), IntegerDatatype, int64(2012)},
+    {mysql.Field{Type: mysql.FIELD_TYPE_YEAR}, "2012", IntegerDatatype, int64(2012)},
+    {mysql.Field{Type: mysql.FIELD_TYPE_BIT}, []byte{1, 2}, IntegerDatatype, int64(258)},
+    {mysql.Field{Type: mysql.FIELD_TYPE_FLOAT}, float32(0.1), FloatDatatype, 0.1},
+    {mysql.Field{Type: mysql.FIELD_TYPE_DOUBLE}, 2.5, FloatDatatype, 2.5},
+    {mysql.Field{Type: mysql.FIELD_TYPE_DECIMAL}, "10.20", StringDatatype, "10.20"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_NEWDECIMAL}, "3.14159", StringDatatype, "3.14159"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_VARCHAR}, "abc", StringDatatype, "abc"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_VAR_STRING}, "abc", StringDatatype, "abc"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_STRING}, []byte("abc"), StringDatatype, "abc"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_ENUM}, "red", StringDatatype, "red"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_SET}, "a,b", StringDatatype, "a,b"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_TINY_BLOB}, "tiny text", StringDatatype, "tiny text"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_BLOB}, []byte("text"), StringDatatype, "text"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_MEDIUM_BLOB}, "medium", StringDatatype, "medium"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_LONG_BLOB, Flags: mysql.FLAG_BINARY}, []byte{0xff, 0}, StringDatatype, "\xff\x00"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_GEOMETRY}, []byte{1, 2}, StringDatatype, "\x01\x02"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_DATE}, "2012-02-04", StringDatatype, "2012-02-04"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_NEWDATE}, "2012-02-04", StringDatatype, "2012-02-04"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_TIME}, "25:40:00", StringDatatype, "25:40:00"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_DATETIME}, "2012-02-04 00:40:00", StringDatatype, "2012-02-04 00:40:00"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_TIMESTAMP}, "2012-02-04 00:40:00", StringDatatype, "2012-02-04 00:40:00"},
+    {mysql.Field{Type: mysql.FIELD_TYPE_NULL}, nil, StringDatatype, nil},
+    {mysql.Field{Type: mysql.FIELD_TYPE_LONG}, nil, IntegerDatatype, nil},
+}
+
+func TestLoadTableFromMySQLTypes(t *testing.T) {
+    for i, test := range mysqlTypeTests {
+        field := test.field
+        field.Name = "col"
+        result := &fakeMySQLResult{
+            fields: []*mysql.Field{&field},
+            rows: []mysql.Row{mysql.Row{test.value}},
+        }
+        info, err := loadTableFromMySQLResult(result, MySQLCharsetUtf8)
+        if err != nil {
+            t.Errorf("test %d type %v: %s", i, test.field.Type, err.Error())
+            continue
+        }
+        if info.ColumnTypes[0] != test.datatype {
+            t.Errorf(
+                "test %d type %v: datatype %s expected %s",
+                i, test.field.Type, info.ColumnTypes[0], test.datatype,
+            )
+        }
+        rows, err := tableRows(info)
+        fatalOnError(err, t)
+        if !reflect.DeepEqual(rows[0][0], test.expected) {
+            t.Errorf(
+                "test %d type %v: value %#v expected %#v",
+                i, test.field.Type, rows[0][0], test.expected,
+            )
+        }
+    }
+}
+
+var mysqlErrorTests = []struct {
+    field mysql.Field
+    value interface{}
+    charset string
+}{
+    {mysql.Field{Type: mysql.FIELD_TYPE_LONGLONG, Flags: mysql.FLAG_UNSIGNED}, uint64(1 << 63), MySQLCharsetUtf8},
+    {mysql.Field{Type: mysql.FIELD_TYPE_LONGLONG, Flags: mysql.FLAG_UNSIGNED}, "18446744073709551615", MySQLCharsetUtf8},
+    {mysql.Field{Type: mysql.FIELD_TYPE_BIT}, []byte{0x80, 0, 0, 0, 0, 0, 0, 0}, MySQLCharsetUtf8},
+    {mysql.Field{Type: mysql.FIELD_TYPE_VARCHAR}, []byte{0xff}, MySQLCharsetUtf8},
+    {mysql.Field{Type: mysql.FIELD_TYPE_VARCHAR}, []byte{0xe9}, MySQLCharsetAscii},
+    {mysql.Field{Type: mysql.FIELD_TYPE_VARCHAR}, "a", "klingon"},
+    {mysql.Field{Type: mysql.FieldType(99)}, "a", MySQLCharsetUtf8},
+}
+
+func TestLoadTableFromMySQLErrors(t *testing.T) {
+    for i, test := range mysqlErrorTests {
+        field := test.field
+        result := &fakeMySQLResult{
+            fields: []*mysql.Field{&field},
+            rows: []mysql.Row{mysql.Row{test.value}},
+        }
+        _, err := loadTableFromMySQLResult(result, test.charset)
+        if err == nil {
+            t.Errorf("test %d type %v: expected error", i, test.field.Type)
+        }
+    }
+}
+
+func TestLoadTableFromMySQLCharset(t *testing.T) {
+    fields := []*mysql.Field{
+        &mysql.Field{Name: "text", Type: mysql.FIELD_TYPE_VAR_STRING},
+        &mysql.Field{
+            Name: "bin",
+            Type: mysql.FIELD_TYPE_STRING,
+            Flags: mysql.FLAG_BINARY,
+        },
+    }
+    result := &fakeMySQLResult{
+        fields: fields,
+        rows: []mysql.Row{
+            mysql.Row{[]byte("caf\xe9"), []byte("caf\xe9")},
+            // cp1252 euro sign and right single quote
+            mysql.Row{[]byte("\x80 it\x92s"), []byte("\x80")},
+        },
+    }
+    info, err := loadTableFromMySQLResult(result, MySQLCharsetLatin1)
+    fatalOnError(err, t)
+    rows, err := tableRows(info)
+    fatalOnError(err, t)
+    if rows[0][0] != "café" {
+        t.Errorf("latin1 decoded to %q", rows[0][0])
+    }
+    if rows[1][0] != "\u20ac it\u2019s" {
+        t.Errorf("latin1 decoded to %q", rows[1][0])
+    }
+    if rows[0][1] != "caf\xe9" || rows[1][1] != "\x80" {
+        t.Errorf("binary field changed to %q %q", rows[0][1], rows[1][1])
+    }
+}
+
+// fake connection returning results in order, a nil result is a statement
+// without a result set
+type fakeMySQLConn struct {
+    results []*fakeMySQLResult
+    pos int
+    // storeResult of results[failAt] fails if set
+    failAt int
+    fail error
+}
+
+func (c *fakeMySQLConn) Query(sql string) error {
+    c.pos = 0
+    return nil
+}
+
+func (c *fakeMySQLConn) storeResult() (mysqlResult, error) {
+    if c.fail != nil && c.pos == c.failAt {
+        return nil, c.fail
+    }
+    if c.results[c.pos] == nil {
+        return nil, errNoResultSet
+    }
+    return c.results[c.pos], nil
+}
+
+func (c *fakeMySQLConn) FreeResult() error {
+    return nil
+}
+
+func (c *fakeMySQLConn) MoreResults() bool {
+    return c.pos < len(c.results) - 1
+}
+
+func (c *fakeMySQLConn) NextResult() (bool, error) {
+    c.pos++
+    return c.pos < len(c.results), nil
+}
+
+func newFakeProcedureConn() *fakeMySQLConn {
+    intField := &mysql.Field{Name: "id", Type: mysql.FIELD_TYPE_LONG}
+    strField := &mysql.Field{Name: "name", Type: mysql.FIELD_TYPE_VAR_STRING}
+    return &fakeMySQLConn{
+        results: []*fakeMySQLResult{
+            &fakeMySQLResult{
+                fields: []*mysql.Field{intField},
+                rows: []mysql.Row{mysql.Row{int32(1)}, mysql.Row{int32(2)}},
+            },
+            &fakeMySQLResult{
+                fields: []*mysql.Field{strField},
+                rows: []mysql.Row{mysql.Row{"tim"}},
+            },
+            nil,
+        },
+    }
+}
+
+func TestLoadTableSetFromMySQL(t *testing.T) {
+    tables, err := loadTableSetFromMySQLConn(
+        newFakeProcedureConn(),
+        "call get_things();",
+        []string{"ids"},
+        MySQLCharsetUtf8,
+    )
+    fatalOnError(err, t)
+    if len(tables) != 2 {
+        t.Fatalf("got %d tables expected 2", len(tables))
+    }
+    if tables["ids"] == nil || tables["ids"].rowCount() != 2 {
+        t.Error("ids table not loaded")
+    }
+    if tables["result1"] == nil || tables["result1"].ColumnNames[0] != "name" {
+        t.Error("second result set not loaded as result1")
+    }
+
+    _, err = loadTableSetFromMySQLConn(
+        newFakeProcedureConn(),
+        "call get_things();",
+        []string{"a", "b", "c"},
+        MySQLCharsetUtf8,
+    )
+    if err == nil {
+        t.Error("expected error for missing result set")
+    }
+
+    conn := newFakeProcedureConn()
+    conn.failAt = 1
+    conn.fail = errors.New("connection lost")
+    _, err = loadTableSetFromMySQLConn(conn, "call get_things();", nil, MySQLCharsetUtf8)
+    if err != conn.fail {
+        t.Errorf("got error %v expected %v", err, conn.fail)
+    }
+
+    // result sets decoded from the connection charset
+    conn = &fakeMySQLConn{
+        results: []*fakeMySQLResult{
+            &fakeMySQLResult{
+                fields: []*mysql.Field{
+                    &mysql.Field{Name: "name", Type: mysql.FIELD_TYPE_VAR_STRING},
+                },
+                rows: []mysql.Row{mysql.Row{[]byte("caf\xe9")}},
+            },
+        },
+    }
+    tables, err = loadTableSetFromMySQLConn(conn, "call get_things();", nil, MySQLCharsetLatin1)
+    fatalOnError(err, t)
+    rows, err := tableRows(tables["result0"])
+    fatalOnError(err, t)
+    if rows[0][0] != "café" {
+        t.Errorf("latin1 result decoded to %q", rows[0][0])
+    }
+    _, err = loadTableSetFromMySQLConn(conn, "call get_things();", nil, "koi8r")
+    if err == nil {
+        t.Error("expected error for unknown charset")
+    }
+}
@@ -0,0 +1,325 @@
+package gemini
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// RowFilter reports whether a fact row, joined to its dimension rows, is
+// selected. The joined row is keyed by dimension column name, measures by
+// fact column name. A fact column with a NULL (-1) id has the fact column
+// set to -1 instead, as the JS client's GeminiDb.factLookup gives.
+type RowFilter func(row map[string]interface{}) bool
+
+// Group of dimension rows at one level of a SliceAndDice result. Values
+// holds a slice of values per dimension table column, one value per row of
+// the group, NULL for the NULL row. SubGroups holds the next level's group
+// for each row, nil at the last level.
+type SliceResult struct {
+    Table string
+    ColumnNames []string
+    Values [][]interface{}
+    SubGroups []*SliceResult
+}
+
+// Group fact rows passing filter (all if nil) by the dimension tables,
+// outermost first, as the JS client's GeminiQuery.slicendice does. Each
+// level has the distinct dimension rows of its group in dimension id
+// order, the NULL row first.
+func (t TableSet) SliceAndDice(tables []string, filter RowFilter) (*SliceResult, error) {
+    keys, err := t.selectKeys(tables, filter)
+    if err != nil {
+        return nil, err
+    }
+    dims := make([][][]interface{}, len(tables))
+    for i, name := range tables {
+        dims[i], err = tableRows(t[name])
+        if err != nil {
+            return nil, err
+        }
+    }
+    result := newSliceResult(tables[0], t[tables[0]])
+    expandSlice(t, tables, dims, keys, result, 0)
+    return result, nil
+}
+
+func newSliceResult(name string, dim *Table) *SliceResult {
+    return &SliceResult{
+        Table : name,
+        ColumnNames : dim.ColumnNames,
+        Values : make([][]interface{}, len(dim.ColumnNames)),
+        SubGroups : []*SliceResult{},
+    }
+}
+
+type idOrder []int64
+
+func (o idOrder) Len() int {
+    return len(o)
+}
+
+func (o idOrder) Less(i, j int) bool {
+    return o[i] < o[j]
+}
+
+func (o idOrder) Swap(i, j int) {
+    o[i], o[j] = o[j], o[i]
+}
+
+// add the distinct ids of keys at level to result, each with the group of
+// keys having that id expanded at the next level
+func expandSlice(t TableSet, tables []string, dims [][][]interface{},
+                 keys [][]int64, result *SliceResult, level int) {
+    groups := make(map[int64][][]int64)
+    var ids idOrder
+    for _, key := range keys {
+        id := key[level]
+        if _, ok := groups[id]; !ok {
+            ids = append(ids, id)
+        }
+        groups[id] = append(groups[id], key)
+    }
+    sort.Sort(ids)
+
+    for _, id := range ids {
+        for j := range result.Values {
+            var v interface{}
+            if id != -1 {
+                v = dims[level][id][j]
+            }
+            result.Values[j] = append(result.Values[j], v)
+        }
+        if level == len(tables) - 1 {
+            result.SubGroups = append(result.SubGroups, nil)
+            continue
+        }
+        sub := newSliceResult(tables[level + 1], t[tables[level + 1]])
+        result.SubGroups = append(result.SubGroups, sub)
+        expandSlice(t, tables, dims, groups[id], sub, level + 1)
+    }
+}
+
+// distinct tuples of the tables' ids of fact rows passing filter, in fact
+// row order
+func (t TableSet) selectKeys(tables []string, filter RowFilter) ([][]int64, error) {
+    if len(tables) == 0 {
+        return nil, fmt.Errorf("SliceAndDice() error, no tables\n")
+    }
+    fact, ok := t["fact"]
+    if !ok {
+        return nil, fmt.Errorf("SliceAndDice() error, can't find fact table\n")
+    }
+    columns, err := t.FactColumns()
+    if err != nil {
+        return nil, err
+    }
+
+    // fact table column holding ids of each table
+    keyColumns := make([]int, len(tables))
+    for i, name := range tables {
+        keyColumns[i] = -1
+        for _, c := range columns {
+            if c.Dimension == name {
+                keyColumns[i] = fact.columnIndex(c.Column)
+            }
+        }
+        if _, ok := t[name]; !ok || keyColumns[i] == -1 {
+            return nil, fmt.Errorf("SliceAndDice() error, can't find %s in tables\n", name)
+        }
+    }
+
+    var joiner *factJoiner
+    if filter != nil {
+        joiner, err = t.newFactJoiner(columns)
+        if err != nil {
+            return nil, fmt.Errorf("SliceAndDice() error, %s\n", err.Error())
+        }
+    }
+
+    var keys [][]int64
+    seen := make(map[string]bool)
+    row := make([]*interface{}, len(fact.ColumnNames))
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+    }
+    for i := 0; i < fact.rowCount(); i++ {
+        err = fact.readRow(i, row)
+        if err != nil {
+            return nil, err
+        }
+        if filter != nil && !filter(joiner.join(row)) {
+            continue
+        }
+        key := make([]int64, len(tables))
+        strs := make([]string, len(tables))
+        for j, column := range keyColumns {
+            id, ok := (*row[column]).(int64)
+            if !ok {
+                return nil, fmt.Errorf("SliceAndDice() error, fact row %d has no id\n", i)
+            }
+            key[j] = id
+            strs[j] = strconv.FormatInt(id, 10)
+        }
+        s := strings.Join(strs, ",")
+        if !seen[s] {
+            seen[s] = true
+            keys = append(keys, key)
+        }
+    }
+
+    // check ids before they are used to index dimension rows
+    for _, key := range keys {
+        for j, id := range key {
+            if id < -1 || id >= int64(t[tables[j]].rowCount()) {
+                return nil, fmt.Errorf("SliceAndDice() error, %s has no row %d\n", tables[j], id)
+            }
+        }
+    }
+    return keys, nil
+}
+
+// joins fact rows to their dimension rows
+type factJoiner struct {
+    columns []FactColumn
+    // fact table column index of each of columns
+    factIndex []int
+    dims [][][]interface{}
+    dimNames [][]string
+}
+
+func (t TableSet) newFactJoiner(columns []FactColumn) (*factJoiner, error) {
+    j := &factJoiner{
+        columns : columns,
+        factIndex : make([]int, len(columns)),
+        dims : make([][][]interface{}, len(columns)),
+        dimNames : make([][]string, len(columns)),
+    }
+    for i, c := range columns {
+        j.factIndex[i] = t["fact"].columnIndex(c.Column)
+        if c.Measure && j.factIndex[i] != -1 {
+            continue
+        }
+        dim, ok := t[c.Dimension]
+        if !ok || j.factIndex[i] == -1 {
+            return nil, fmt.Errorf("can't find %s for fact column %s", c.Dimension, c.Column)
+        }
+        var err error
+        j.dims[i], err = tableRows(dim)
+        if err != nil {
+            return nil, err
+        }
+        j.dimNames[i] = dim.ColumnNames
+    }
+    return j, nil
+}
+
+// fact row joined to its dimension rows, as GeminiDb.joinFactToDim
+func (j *factJoiner) join(row []*interface{}) map[string]interface{} {
+    joined := make(map[string]interface{})
+    for i, c := range j.columns {
+        if c.Measure {
+            joined[c.Column] = *row[j.factIndex[i]]
+            continue
+        }
+        id, ok := (*row[j.factIndex[i]]).(int64)
+        if !ok || id < 0 || id >= int64(len(j.dims[i])) {
+            joined[c.Column] = int64(-1)
+            continue
+        }
+        for k, name := range j.dimNames[i] {
+            joined[name] = j.dims[i][id][k]
+        }
+    }
+    return joined
+}
+
+// Write result as JSON in the structure GeminiQuery.slicendice gives: an
+// object with an array per dimension column, and the array of sub groups
+// (null at the last level) under both the table name and "subGroup"
+func (r *SliceResult) JSONWrite(w io.Writer) error {
+    var opts JSONOptions
+    err := opts.check()
+    if err != nil {
+        return err
+    }
+    bw := bufio.NewWriter(w)
+    err = r.jsonWrite(bw, opts)
+    if err != nil {
+        return err
+    }
+    return bw.Flush()
+}
+
+func (r *SliceResult) jsonWrite(w *bufio.Writer, opts JSONOptions) error {
+    err := w.WriteByte('{')
+    if err != nil {
+        return err
+    }
+    for i, key := range []string{r.Table, "subGroup"} {
+        if i != 0 {
+            err = w.WriteByte(',')
+            if err != nil {
+                return err
+            }
+        }
+        err = writeJSON(w, key)
+        if err != nil {
+            return err
+        }
+        _, err = w.WriteString(":[")
+        if err != nil {
+            return err
+        }
+        for j, sub := range r.SubGroups {
+            if j != 0 {
+                err = w.WriteByte(',')
+                if err != nil {
+                    return err
+                }
+            }
+            if sub == nil {
+                _, err = w.WriteString("null")
+            } else {
+                err = sub.jsonWrite(w, opts)
+            }
+            if err != nil {
+                return err
+            }
+        }
+        err = w.WriteByte(']')
+        if err != nil {
+            return err
+        }
+    }
+
+    var buf []byte
+    for i, name := range r.ColumnNames {
+        buf = append(buf[:0], ',')
+        js, err := json.Marshal(name)
+        if err != nil {
+            return err
+        }
+        buf = append(buf, js...)
+        buf = append(buf, ':', '[')
+        for j, v := range r.Values[i] {
+            if j != 0 {
+                buf = append(buf, ',')
+            }
+            buf, err = appendJSONValue(buf, v, opts)
+            if err != nil {
+                return err
+            }
+        }
+        buf = append(buf, ']')
+        _, err = w.Write(buf)
+        if err != nil {
+            return err
+        }
+    }
+    return w.WriteByte('}')
+}
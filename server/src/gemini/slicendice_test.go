@@ -0,0 +1,118 @@
+package gemini
+
+import (
+    "bytes"
+    "testing"
+)
+
+// expected output is JSON.stringify of GeminiQuery.slicendice's result for
+// the same tables and query
+var sliceAndDiceTests = []struct {
+    tables []string
+    filter RowFilter
+    expected string
+}{
+    {
+        []string{"names", "ages"},
+        nil,
+        `{"names":[{"ages":[null],"subGroup":[null],"age_id":[0],"age":[35]},` +
+        `{"ages":[null,null],"subGroup":[null,null],"age_id":[0,1],"age":[35,40]},` +
+        `{"ages":[null],"subGroup":[null],"age_id":[null],"age":[null]}],` +
+        `"subGroup":[{"ages":[null],"subGroup":[null],"age_id":[0],"age":[35]},` +
+        `{"ages":[null,null],"subGroup":[null,null],"age_id":[0,1],"age":[35,40]},` +
+        `{"ages":[null],"subGroup":[null],"age_id":[null],"age":[null]}],` +
+        `"name_id":[null,0,1],"name":[null,"tim","scarlet"]}`,
+    },
+    {
+        []string{"ages", "names"},
+        func(row map[string]interface{}) bool {
+            return row["name"] != "tim"
+        },
+        `{"ages":[{"names":[null],"subGroup":[null],"name_id":[1],"name":["scarlet"]},` +
+        `{"names":[null],"subGroup":[null],"name_id":[null],"name":[null]}],` +
+        `"subGroup":[{"names":[null],"subGroup":[null],"name_id":[1],"name":["scarlet"]},` +
+        `{"names":[null],"subGroup":[null],"name_id":[null],"name":[null]}],` +
+        `"age_id":[null,0],"age":[null,35]}`,
+    },
+}
+
+func TestSliceAndDice(t *testing.T) {
+    fact := &Table{
+        ColumnNames : []string{"name_id", "age_id"},
+        ColumnTypes : []ColumnDatatype{IntegerDatatype, IntegerDatatype},
+    }
+    fact.initData()
+    for _, row := range [][]interface{}{{1, -1}, {0, 1}, {0, 0}, {1, -1}, {-1, 0}} {
+        fatalOnError(fact.writeRow(row), t)
+    }
+    names := &Table{
+        ColumnNames : []string{"name_id", "name"},
+        ColumnTypes : []ColumnDatatype{IntegerDatatype, StringDatatype},
+    }
+    names.initData()
+    for _, row := range [][]interface{}{{0, "tim"}, {1, "scarlet"}} {
+        fatalOnError(names.writeRow(row), t)
+    }
+    ages := &Table{
+        ColumnNames : []string{"age_id", "age"},
+        ColumnTypes : []ColumnDatatype{IntegerDatatype, IntegerDatatype},
+    }
+    ages.initData()
+    for _, row := range [][]interface{}{{0, 35}, {1, 40}} {
+        fatalOnError(ages.writeRow(row), t)
+    }
+    tables := TableSet{"fact" : fact, "names" : names, "ages" : ages}
+    for _, test := range sliceAndDiceTests {
+        result, err := tables.SliceAndDice(test.tables, test.filter)
+        fatalOnError(err, t)
+        var buf bytes.Buffer
+        fatalOnError(result.JSONWrite(&buf), t)
+        if buf.String() != test.expected {
+            t.Errorf("%v: got\n%s\nexpected\n%s", test.tables, buf.String(), test.expected)
+        }
+    }
+
+    _, err := tables.SliceAndDice([]string{"names", "heights"}, nil)
+    if err == nil {
+        t.Error("expected error for unknown table")
+    }
+    _, err = tables.SliceAndDice(nil, nil)
+    if err == nil {
+        t.Error("expected error for no tables")
+    }
+}
+
+func TestSliceAndDicePerformQueries(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"route_short_name", "distance"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, FloatDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"10", 2.0}, {"2", 3.5}, {"N1", 1.0}, {nil, 2.0}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "distance" : SourceColumnProperty{SortDirection: Desc},
+        },
+    }
+    tables, err := d.PerformQueries()
+    fatalOnError(err, t)
+    result, err := tables.SliceAndDice(
+        []string{"distances", "route_short_names"},
+        func(row map[string]interface{}) bool {
+            return row["route_short_name"] != "N1"
+        },
+    )
+    fatalOnError(err, t)
+    // distances sorted descending, routes within each distance
+    distances := result.Values[1]
+    if len(distances) != 2 || distances[0] != 3.5 {
+        t.Fatalf("distances %v", distances)
+    }
+    routes := result.SubGroups[1].Values[1]
+    if len(routes) != 2 || routes[0] != nil || routes[1] != "10" {
+        t.Errorf("routes for distance 2 %v", routes)
+    }
+}
@@ -0,0 +1,226 @@
+package gemini
+
+import (
+    "database/sql"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// StoreTable dialects
+const (
+    SqliteDialect string = "sqlite"
+    MySQLDialect string = "mysql"
+    PostgresDialect string = "postgres"
+)
+
+type sqlDialect struct {
+    quote func(name string) string
+    types map[ColumnDatatype]string
+    // placeholder for parameter n, counting from 1
+    placeholder func(n int) string
+    maxParameters int
+}
+
+func questionPlaceholder(n int) string {
+    return "?"
+}
+
+func dollarPlaceholder(n int) string {
+    return "$" + strconv.Itoa(n)
+}
+
+func mysqlQuoteIdentifier(name string) string {
+    return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+var sqlDialects map[string]*sqlDialect = map[string]*sqlDialect{
+    SqliteDialect : &sqlDialect{
+        quote : quoteIdentifier,
+        types : mapDatatypeToSqlite,
+        placeholder : questionPlaceholder,
+        maxParameters : sqliteMaxParameters,
+    },
+    MySQLDialect : &sqlDialect{
+        quote : mysqlQuoteIdentifier,
+        types : map[ColumnDatatype]string{
+            IntegerDatatype : "bigint",
+            StringDatatype : "text",
+            FloatDatatype : "double",
+        },
+        placeholder : questionPlaceholder,
+        maxParameters : 65535,
+    },
+    PostgresDialect : &sqlDialect{
+        quote : quoteIdentifier,
+        types : map[ColumnDatatype]string{
+            IntegerDatatype : "bigint",
+            StringDatatype : "text",
+            FloatDatatype : "double precision",
+        },
+        placeholder : dollarPlaceholder,
+        maxParameters : 65535,
+    },
+}
+
+// Create table name in database db and insert table rows in a
+// transaction. The table is created first, outside the transaction, as
+// MySQL commits a create table implicitly, and dropped again if the rows
+// can't be inserted. dialect is one of SqliteDialect, MySQLDialect or
+// PostgresDialect and selects column types, identifier quoting and
+// placeholders, db must use a driver for that database.
+func StoreTable(db *sql.DB, dialect, name string, table *Table) error {
+    dia, ok := sqlDialects[dialect]
+    if !ok {
+        return fmt.Errorf("StoreTable() error, unknown dialect %s\n", dialect)
+    }
+    err := checkIdentifier(name)
+    if err != nil {
+        return fmt.Errorf("StoreTable() error, %s\n", err.Error())
+    }
+    for _, column := range table.ColumnNames {
+        err = checkIdentifier(column)
+        if err != nil {
+            return fmt.Errorf("StoreTable() error, %s\n", err.Error())
+        }
+    }
+
+    columns := make([]string, len(table.ColumnNames))
+    for i, column := range table.ColumnNames {
+        columns[i] = dia.quote(column) + " " + dia.types[table.ColumnTypes[i]]
+    }
+    queryStr := fmt.Sprintf(
+        "create table %s (%s)",
+        dia.quote(name),
+        strings.Join(columns, ","),
+    )
+    _, err = db.Exec(queryStr)
+    if err != nil {
+        return fmt.Errorf("StoreTable() error, %s\nquery:\n%s\n", err.Error(), queryStr)
+    }
+
+    err = insertRowsTx(db, dia, name, table)
+    if err != nil {
+        db.Exec("drop table " + dia.quote(name))
+        return err
+    }
+    return nil
+}
+
+// Store each table of the set under its name, see StoreTable
+func StoreTableSet(db *sql.DB, dialect string, tables TableSet) error {
+    for _, name := range tables.Names() {
+        err := StoreTable(db, dialect, name, tables[name])
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// insert table rows in a transaction, rolled back if any insert fails
+func insertRowsTx(db *sql.DB, dia *sqlDialect, name string, table *Table) error {
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("StoreTable() error, %s\n", err.Error())
+    }
+    err = storeTableTx(tx, dia, name, table)
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("StoreTable() error, %s\n", err.Error())
+    }
+    return nil
+}
+
+func storeTableTx(tx *sql.Tx, dia *sqlDialect, name string, table *Table) error {
+    cols := len(table.ColumnNames)
+    if cols == 0 || table.rowCount() == 0 {
+        return nil
+    }
+    batchRows := dia.maxParameters / cols
+    if batchRows > SqliteBatchRows {
+        batchRows = SqliteBatchRows
+    }
+    if batchRows < 1 {
+        batchRows = 1
+    }
+
+    var queryStr string
+    var err error
+    var stmt *sql.Stmt
+    stmtRows := 0
+    defer func() {
+        if stmt != nil {
+            stmt.Close()
+        }
+    }()
+
+    row := make([]*interface{}, cols)
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+    }
+    args := make([]interface{}, 0, batchRows * cols)
+    for i := 0; i < table.rowCount(); i += batchRows {
+        n := table.rowCount() - i
+        if n > batchRows {
+            n = batchRows
+        }
+        // full batches share one statement, the last may need its own
+        if stmt == nil || stmtRows != n {
+            if stmt != nil {
+                stmt.Close()
+            }
+            queryStr = dia.insertQuery(name, table.ColumnNames, n)
+            stmt, err = tx.Prepare(queryStr)
+            if err != nil {
+                stmt = nil
+                return fmt.Errorf("StoreTable() error, %s\nquery:\n%s\n", err.Error(), queryStr)
+            }
+            stmtRows = n
+        }
+
+        args = args[:0]
+        for j := i; j < i + n; j++ {
+            err = table.readRow(j, row)
+            if err != nil {
+                return err
+            }
+            for k := 0; k < cols; k++ {
+                args = append(args, *row[k])
+            }
+        }
+        _, err = stmt.Exec(args...)
+        if err != nil {
+            return fmt.Errorf("StoreTable() error, %s, row %d\n", err.Error(), i)
+        }
+    }
+    return nil
+}
+
+// make "insert into name (a,b) values (?,?),(?,?)..." for rows rows
+func (dia *sqlDialect) insertQuery(name string, columns []string, rows int) string {
+    quoted := make([]string, len(columns))
+    for i, column := range columns {
+        quoted[i] = dia.quote(column)
+    }
+    values := make([]string, rows)
+    placeholders := make([]string, len(columns))
+    n := 1
+    for i := 0; i < rows; i++ {
+        for j := 0; j < len(columns); j++ {
+            placeholders[j] = dia.placeholder(n)
+            n++
+        }
+        values[i] = "(" + strings.Join(placeholders, ",") + ")"
+    }
+    return fmt.Sprintf(
+        "insert into %s (%s) values %s",
+        dia.quote(name),
+        strings.Join(quoted, ","),
+        strings.Join(values, ","),
+    )
+}
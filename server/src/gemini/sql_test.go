@@ -0,0 +1,255 @@
+package gemini
+
+import (
+    "database/sql"
+    "database/sql/driver"
+    "io"
+    "reflect"
+    "sqlite"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// database/sql driver over the sqlite binding so StoreTable can be tested
+// without a database server
+type sqliteDriver struct{}
+
+type sqliteDriverConn struct {
+    conn *sqlite.Conn
+}
+
+type sqliteDriverStmt struct {
+    stmt *sqlite.Stmt
+}
+
+type sqliteDriverRows struct {
+    stmt *sqlite.Stmt
+}
+
+func (sqliteDriver) Open(name string) (driver.Conn, error) {
+    conn, err := sqlite.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    return &sqliteDriverConn{conn}, nil
+}
+
+func (c *sqliteDriverConn) Prepare(query string) (driver.Stmt, error) {
+    stmt, err := c.conn.Prepare(query)
+    if err != nil {
+        return nil, err
+    }
+    return &sqliteDriverStmt{stmt}, nil
+}
+
+func (c *sqliteDriverConn) Close() error {
+    return c.conn.Close()
+}
+
+func (c *sqliteDriverConn) Begin() (driver.Tx, error) {
+    err := c.conn.Exec("begin;")
+    if err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+func (c *sqliteDriverConn) Commit() error {
+    return c.conn.Exec("commit;")
+}
+
+func (c *sqliteDriverConn) Rollback() error {
+    return c.conn.Exec("rollback;")
+}
+
+func (s *sqliteDriverStmt) Close() error {
+    return s.stmt.Finalize()
+}
+
+func (s *sqliteDriverStmt) NumInput() int {
+    return -1
+}
+
+func driverArgs(values []driver.Value) []interface{} {
+    args := make([]interface{}, len(values))
+    for i, v := range values {
+        args[i] = v
+    }
+    return args
+}
+
+func (s *sqliteDriverStmt) Exec(values []driver.Value) (driver.Result, error) {
+    err := s.stmt.Exec(driverArgs(values)...)
+    if err != nil {
+        return nil, err
+    }
+    s.stmt.Next()
+    if s.stmt.Error() != nil {
+        return nil, s.stmt.Error()
+    }
+    return driver.ResultNoRows, nil
+}
+
+func (s *sqliteDriverStmt) Query(values []driver.Value) (driver.Rows, error) {
+    err := s.stmt.Exec(driverArgs(values)...)
+    if err != nil {
+        return nil, err
+    }
+    return &sqliteDriverRows{s.stmt}, nil
+}
+
+func (r *sqliteDriverRows) Columns() []string {
+    columns := make([]string, r.stmt.ColumnCount())
+    for i := range columns {
+        columns[i] = r.stmt.ColumnName(i)
+    }
+    return columns
+}
+
+func (r *sqliteDriverRows) Close() error {
+    return nil
+}
+
+func (r *sqliteDriverRows) Next(dest []driver.Value) error {
+    if !r.stmt.Next() {
+        if r.stmt.Error() != nil {
+            return r.stmt.Error()
+        }
+        return io.EOF
+    }
+    raw := make([]interface{}, len(dest))
+    for i := range raw {
+        raw[i] = new([]byte)
+    }
+    err := r.stmt.Scan(raw...)
+    if err != nil {
+        return err
+    }
+    for i := range dest {
+        s := string(*raw[i].(*[]byte))
+        switch r.stmt.ColumnType(i) {
+            case sqlite.IntegerDatatype:
+                dest[i], err = strconv.ParseInt(s, 10, 64)
+            case sqlite.FloatDatatype:
+                dest[i], err = strconv.ParseFloat(s, 64)
+            case sqlite.TextDatatype:
+                dest[i] = s
+            default:
+                // NULL, StoreTable doesn't write blobs
+                dest[i] = nil
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func init() {
+    sql.Register("gemini_sqlite", sqliteDriver{})
+}
+
+func TestStoreTable(t *testing.T) {
+    db, err := sql.Open("gemini_sqlite", ":memory:")
+    fatalOnError(err, t)
+    defer db.Close()
+    // one connection so every statement sees the same memory database
+    db.SetMaxOpenConns(1)
+
+    info := &Table{
+        ColumnNames : []string{"name", "age", "height"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            IntegerDatatype,
+            FloatDatatype,
+        },
+    }
+    info.initData()
+    for _, row := range [][]interface{}{
+        {"tim", 5, 1.1},
+        {nil, 4, nil},
+        {"it's", nil, -0.25},
+    } {
+        fatalOnError(info.writeRow(row), t)
+    }
+    err = StoreTableSet(db, SqliteDialect, TableSet{"my people" : info})
+    fatalOnError(err, t)
+
+    rows, err := db.Query(`select name, age, height from "my people";`)
+    fatalOnError(err, t)
+    var stored [][]interface{}
+    for rows.Next() {
+        var name sql.NullString
+        var age sql.NullInt64
+        var height sql.NullFloat64
+        fatalOnError(rows.Scan(&name, &age, &height), t)
+        row := []interface{}{nil, nil, nil}
+        if name.Valid {
+            row[0] = name.String
+        }
+        if age.Valid {
+            row[1] = age.Int64
+        }
+        if height.Valid {
+            row[2] = height.Float64
+        }
+        stored = append(stored, row)
+    }
+    fatalOnError(rows.Err(), t)
+    expected, err := tableRows(info)
+    fatalOnError(err, t)
+    if !reflect.DeepEqual(stored, expected) {
+        t.Errorf("stored %v expected %v", stored, expected)
+    }
+
+    err = StoreTable(db, SqliteDialect, "my people", info)
+    if err == nil {
+        t.Error("expected error storing existing table")
+    }
+
+    // table is dropped when its rows can't be stored, integer column
+    // holding text can't be decoded
+    bad := &Table{
+        ColumnNames : []string{"n"},
+        ColumnTypes : []ColumnDatatype{IntegerDatatype},
+    }
+    bad.initData()
+    fatalOnError(bad.writeRow([]interface{}{1}), t)
+    fatalOnError(bad.writeRow([]interface{}{"one"}), t)
+    err = StoreTable(db, SqliteDialect, "bad", bad)
+    if err == nil {
+        t.Error("expected error storing undecodable rows")
+    }
+    var count int
+    err = db.QueryRow(`select count(1) from sqlite_master where name in ('bad', 'my people');`).Scan(&count)
+    fatalOnError(err, t)
+    if count != 1 {
+        t.Errorf("%d tables after failed store, expected only my people", count)
+    }
+    err = StoreTable(db, "oracle", "x", info)
+    if err == nil {
+        t.Error("expected error for unknown dialect")
+    }
+}
+
+var insertQueryTests = []struct {
+    dialect string
+    query string
+}{
+    {SqliteDialect, `insert into "t" ("a","b""c") values (?,?),(?,?)`},
+    {MySQLDialect, "insert into `t` (`a`,`b\"c`) values (?,?),(?,?)"},
+    {PostgresDialect, `insert into "t" ("a","b""c") values ($1,$2),($3,$4)`},
+}
+
+func TestDialectInsertQuery(t *testing.T) {
+    for _, test := range insertQueryTests {
+        query := sqlDialects[test.dialect].insertQuery("t", []string{"a", `b"c`}, 2)
+        if query != test.query {
+            t.Errorf("%s: %s expected %s", test.dialect, query, test.query)
+        }
+    }
+    if q := mysqlQuoteIdentifier("a`b"); !strings.Contains(q, "a``b") {
+        t.Errorf("mysql quoted %s", q)
+    }
+}
@@ -1,14 +1,15 @@
 package gemini
 
 import (
-    "github.com/timob/GoMySQL/src/mysql"
     "fmt"
     "sqlite"
     "errors"
-    "regexp"
+    "strings"
     "encoding/binary"
     "encoding/json"
     "io"
+    "math"
+    "sort"
 )
 
 var tableSpace [50*1024*1024]byte
@@ -39,6 +40,35 @@ type Table struct {
 
 type TableSet map[string]*Table
 
+// Table names in output order: the fact table, then the dimension tables
+// in the order of their columns in the fact table (see FactColumns), then
+// any other tables sorted by name
+func (t TableSet) Names() []string {
+    names := make([]string, 0, len(t))
+    seen := make(map[string]bool)
+    add := func(name string) {
+        if _, ok := t[name]; ok && !seen[name] {
+            names = append(names, name)
+            seen[name] = true
+        }
+    }
+    add("fact")
+    columns, err := t.FactColumns()
+    if err != nil {
+        columns = t.conventionFactColumns()
+    }
+    for _, column := range columns {
+        add(column.Dimension)
+    }
+    rest := make([]string, 0, len(t))
+    for name := range t {
+        if !seen[name] {
+            rest = append(rest, name)
+        }
+    }
+    sort.Strings(rest)
+    return append(names, rest...)
+}
 
 func ClearTableSpace() {
     allocedSpace = 0
@@ -67,6 +97,36 @@ func (t *Table) rowCount() int {
     return len(t.RowOffsets)
 }
 
+// index of column name, -1 if not found
+func (t *Table) columnIndex(name string) int {
+    for i, column := range t.ColumnNames {
+        if column == name {
+            return i
+        }
+    }
+    return -1
+}
+
+// all rows of table decoded
+func tableRows(t *Table) ([][]interface{}, error) {
+    rows := make([][]interface{}, t.rowCount())
+    row := make([]*interface{}, len(t.ColumnTypes))
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+    }
+    for i := 0; i < t.rowCount(); i++ {
+        err := t.readRow(i, row)
+        if err != nil {
+            return nil, err
+        }
+        rows[i] = make([]interface{}, len(row))
+        for j := 0; j < len(row); j++ {
+            rows[i][j] = *row[j]
+        }
+    }
+    return rows, nil
+}
+
 func (t *Table) writeRow(rowValues []interface{}) error {
     t.RowOffsets = append(t.RowOffsets, len(t.Data))
 
@@ -84,10 +144,17 @@ func (t *Table) writeRow(rowValues []interface{}) error {
 		case IntegerDatatype:		    
             rep = fmt.Sprintf("%d", rowValues[i])
 		case FloatDatatype:		    
-            rep = fmt.Sprintf("%f", rowValues[i])
+            rep = fmt.Sprintf("%v", rowValues[i])
 		case StringDatatype:
             rep = rowValues[i].(string)
 	    }	    
+        if len(rep) > math.MaxInt16 {
+            return fmt.Errorf(
+                "gemini table value of %d bytes too long for column %s",
+                len(rep),
+                t.ColumnNames[i],
+            )
+        }
 	    err := binary.Write(&t.Data, binary.LittleEndian, int16(len(rep)))       
         if err != nil {
             return err
@@ -134,56 +201,6 @@ func (t *Table) readRow(rowNum int, rowValues []*interface{}) error {
 }
 
 
-func LoadTableFromMySQL(result *mysql.Result) (*Table, error) {
-    var info Table
-    
-    fields := result.FetchFields()
-    info.ColumnNames = make([]string, len(fields))
-    info.ColumnTypes = make([]ColumnDatatype, len(fields))
-    for i := 0; i < len(fields); i++ {
-        info.ColumnNames[i] = fields[i].Name
-        switch fields[i].Type {
-            case mysql.FIELD_TYPE_VAR_STRING,
-	             mysql.FIELD_TYPE_DECIMAL,
-	             mysql.FIELD_TYPE_NEWDECIMAL,
-                 mysql.FIELD_TYPE_VARCHAR:
-                info.ColumnTypes[i] = StringDatatype
-            case mysql.FIELD_TYPE_TINY,
-             	 mysql.FIELD_TYPE_SHORT,
-	             mysql.FIELD_TYPE_LONG,
-	             mysql.FIELD_TYPE_LONGLONG,
-	             mysql.FIELD_TYPE_INT24:
-	            info.ColumnTypes[i] = IntegerDatatype
-            case mysql.FIELD_TYPE_FLOAT,
-                 mysql.FIELD_TYPE_DOUBLE:
-	            info.ColumnTypes[i] = FloatDatatype
-            default:
-                return nil, errors.New(
-                    fmt.Sprintf(
-                        "LoadTableFromMySQL unkown type %v\n",
-                        fields[i].Type,
-                    ),
-                )
-        }        
-    }
-    
-    info.initData()
-    
-    for i := 0;;i++ {
-        row := result.FetchRow()
-        if row == nil {
-            break
-        }
-        err := info.writeRow(row)
-        if err != nil {
-            return nil, err
-        }
-    }
-    
-    return &info, nil
-}
-
-
 func LoadTableFromSqlite(s *sqlite.Stmt) (*Table, error) {
     var info Table
     var cols, colptrs []interface{}
@@ -276,117 +293,535 @@ var mapDatatypeToSqlite map[ColumnDatatype]string = map[ColumnDatatype]string{
     FloatDatatype : "real",
 }
 
+// Quote name for use as an sqlite identifier
+func quoteIdentifier(name string) string {
+    return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
+
+// Check name can be used as an sqlite identifier, any characters are
+// allowed once quoted except NUL
+func checkIdentifier(name string) error {
+    if name == "" {
+        return errors.New("empty sqlite identifier")
+    }
+    if strings.IndexByte(name, 0) != -1 {
+        return fmt.Errorf("sqlite identifier %q contains NUL", name)
+    }
+    return nil
+}
+
+// Rows per insert statement used by StoreTableToSqlite
+const SqliteBatchRows = 100
+
+// Sqlite limits the number of bound parameters in a statement
+const sqliteMaxParameters = 999
+
+// StoreTableToSqliteMode modes
+const (
+    // create new table, error if it already exists
+    SqliteCreate string = "create"
+    // drop any existing table and create a new one
+    SqliteReplace string = "replace"
+    // add rows to existing table, creating it if it doesn't exist
+    SqliteAppend string = "append"
+    // add rows to existing table, replacing rows with the same key
+    SqliteUpsert string = "upsert"
+)
+
 func StoreTableToSqlite(conn *sqlite.Conn , name string, tinfo *Table) error {
-    queryStr := fmt.Sprintf("create table %s (", name)
+    return StoreTableToSqliteBatch(conn, name, tinfo, SqliteBatchRows)
+}
+
+// Store table in new sqlite table, rows are inserted in a single
+// transaction by a prepared statement inserting batchRows rows at a time
+// (fewer if there would be more bound parameters than sqlite allows).
+func StoreTableToSqliteBatch(conn *sqlite.Conn, name string, tinfo *Table,
+                             batchRows int) error {
+    return storeTableToSqlite(conn, name, tinfo, SqliteCreate, nil, batchRows)
+}
+
+// Store table in sqlite table using mode. For SqliteAppend and SqliteUpsert
+// an existing table must have a column of matching type for each table
+// column, other columns are left NULL. SqliteUpsert needs key columns, a
+// unique index is created on them and stored rows update the table's
+// columns of existing rows with the same key values, leaving their other
+// columns unchanged. Rows with a NULL key value are always added.
+func StoreTableToSqliteMode(conn *sqlite.Conn, name string, tinfo *Table,
+                            mode string, key ...string) error {
+    return storeTableToSqlite(conn, name, tinfo, mode, key, SqliteBatchRows)
+}
+
+func storeTableToSqlite(conn *sqlite.Conn, name string, tinfo *Table,
+                        mode string, key []string, batchRows int) error {
+    err := checkIdentifier(name)
+    if err != nil {
+        return fmt.Errorf("StoreTableToSqlite(): %s", err.Error())
+    }
     for i := 0; i < len(tinfo.ColumnNames); i++ {
-        if i != 0 {
-            queryStr += ","
+        err = checkIdentifier(tinfo.ColumnNames[i])
+        if err != nil {
+            return fmt.Errorf("StoreTableToSqlite(): %s", err.Error())
         }
-        queryStr += 
-            tinfo.ColumnNames[i] + 
-            " "  +
-            mapDatatypeToSqlite[tinfo.ColumnTypes[i]]
     }
-    queryStr += ");"
-    
-    err := conn.Exec(queryStr)
+    switch mode {
+        case SqliteCreate, SqliteReplace, SqliteAppend:
+        case SqliteUpsert:
+            if len(key) == 0 {
+                return errors.New("StoreTableToSqlite(): upsert without key columns")
+            }
+            for _, column := range key {
+                if tinfo.columnIndex(column) == -1 {
+                    return fmt.Errorf(
+                        "StoreTableToSqlite(): key column %s not in table",
+                        column,
+                    )
+                }
+            }
+        default:
+            return fmt.Errorf("StoreTableToSqlite(): unknown mode %s", mode)
+    }
+
+    if batchRows * len(tinfo.ColumnTypes) > sqliteMaxParameters {
+        batchRows = sqliteMaxParameters / len(tinfo.ColumnTypes)
+    }
+    if batchRows < 1 {
+        batchRows = 1
+    }
+
+    err = conn.Exec("begin;")
     if err != nil {
-        return fmt.Errorf("StoreTableToSqlite(): %s , %s,", err.Error(), queryStr)
+        return fmt.Errorf("StoreTableToSqlite(): %s", err.Error())
     }
-    
-    row := make([]*interface{}, len(tinfo.ColumnTypes))
-    for i := 0; i < len(row); i++ {
-        row[i] = new(interface{})
+    err = storeTableRows(conn, name, tinfo, mode, key, batchRows)
+    if err != nil {
+        conn.Exec("rollback;")
+        return err
     }
-    for i := 0; i < tinfo.rowCount(); i++ {
-        queryStr = fmt.Sprintf("insert into %s values (", name)
-        err := tinfo.readRow(i, row)
+    err = conn.Exec("commit;")
+    if err != nil {
+        return fmt.Errorf("StoreTableToSqlite(): %s", err.Error())
+    }
+    return nil
+}
+
+// create or check table for mode then insert rows, in a transaction
+func storeTableRows(conn *sqlite.Conn, name string, tinfo *Table,
+                    mode string, key []string, batchRows int) error {
+    existing, err := sqliteTableColumns(conn, name)
+    if err != nil {
+        return err
+    }
+
+    create := true
+    switch mode {
+        case SqliteReplace:
+            if existing != nil {
+                queryStr := "drop table " + quoteIdentifier(name) + ";"
+                err = conn.Exec(queryStr)
+                if err != nil {
+                    return fmt.Errorf("StoreTableToSqlite(): %s , %s,", err.Error(), queryStr)
+                }
+            }
+        case SqliteAppend, SqliteUpsert:
+            if existing != nil {
+                err = checkSqliteColumns(name, existing, tinfo)
+                if err != nil {
+                    return err
+                }
+                create = false
+            }
+    }
+
+    if create {
+        queryStr := fmt.Sprintf("create table %s (", quoteIdentifier(name))
+        for i := 0; i < len(tinfo.ColumnNames); i++ {
+            if i != 0 {
+                queryStr += ","
+            }
+            queryStr += 
+                quoteIdentifier(tinfo.ColumnNames[i]) + 
+                " "  +
+                mapDatatypeToSqlite[tinfo.ColumnTypes[i]]
+        }
+        queryStr += ");"
+        
+        err = conn.Exec(queryStr)
         if err != nil {
-            return err
+            return fmt.Errorf("StoreTableToSqlite(): %s , %s,", err.Error(), queryStr)
         }
-        for j := 0; j < len(row); j++ {
-            if j != 0 {
-                queryStr += ","
+    }
+
+    conflict := ""
+    if mode == SqliteUpsert {
+        quotedKey := make([]string, len(key))
+        for i, column := range key {
+            quotedKey[i] = quoteIdentifier(column)
+        }
+        queryStr := fmt.Sprintf(
+            "create unique index if not exists %s on %s (%s);",
+            quoteIdentifier(sqliteKeyIndexName(name, key)),
+            quoteIdentifier(name),
+            strings.Join(quotedKey, ","),
+        )
+        err = conn.Exec(queryStr)
+        if err != nil {
+            return fmt.Errorf("StoreTableToSqlite(): %s , %s,", err.Error(), queryStr)
+        }
+
+        // only the stored columns of a conflicting row are updated
+        var set []string
+        for _, column := range tinfo.ColumnNames {
+            if !stringsContain(key, column) {
+                set = append(set, quoteIdentifier(column) + "=excluded." + quoteIdentifier(column))
             }
-            value := *(row[j])
-            if value == nil {
-                queryStr += "null"
+        }
+        conflict = " on conflict(" + strings.Join(quotedKey, ",") + ") do nothing"
+        if len(set) > 0 {
+            conflict = " on conflict(" + strings.Join(quotedKey, ",") + ") do update set " +
+                       strings.Join(set, ",")
+        }
+    }
+
+    if len(tinfo.ColumnTypes) == 0 || tinfo.rowCount() == 0 {
+        return nil
+    }
+    return insertTableRows(conn, name, tinfo, conflict, batchRows)
+}
+
+// Name of the unique index for upsert key columns. Each part is prefixed
+// with its length so different tables and keys never share a name.
+func sqliteKeyIndexName(name string, key []string) string {
+    index := ""
+    for _, part := range append([]string{name}, key...) {
+        index += fmt.Sprintf("%d_%s_", len(part), part)
+    }
+    return index + "key"
+}
+
+func stringsContain(a []string, s string) bool {
+    for _, v := range a {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+type sqliteColumn struct {
+    name string
+    datatype string
+}
+
+// columns of existing sqlite table, nil if there is no table
+func sqliteTableColumns(conn *sqlite.Conn, name string) ([]sqliteColumn, error) {
+    queryStr := fmt.Sprintf("pragma table_info(%s);", quoteIdentifier(name))
+    stmt, err := conn.Prepare(queryStr)
+    if err != nil {
+        return nil, fmt.Errorf("StoreTableToSqlite(): %s , %s,", err.Error(), queryStr)
+    }
+    defer stmt.Finalize()
+
+    var columns []sqliteColumn
+    var cid, notNull, pk int
+    var column sqliteColumn
+    var dflt string
+    for stmt.Next() {
+        err = stmt.Scan(&cid, &column.name, &column.datatype, &notNull, &dflt, &pk)
+        if err != nil {
+            return nil, fmt.Errorf("StoreTableToSqlite(): %s , %s,", err.Error(), queryStr)
+        }
+        columns = append(columns, column)
+    }
+    if stmt.Error() != nil {
+        return nil, fmt.Errorf("StoreTableToSqlite(): %s , %s,", stmt.Error().Error(), queryStr)
+    }
+    return columns, nil
+}
+
+// Sqlite type affinity of declared column type
+func sqliteAffinity(declared string) string {
+    declared = strings.ToLower(declared)
+    switch {
+        case strings.Contains(declared, "int"):
+            return "integer"
+        case strings.Contains(declared, "char"),
+             strings.Contains(declared, "clob"),
+             strings.Contains(declared, "text"):
+            return "text"
+        case declared == "" || strings.Contains(declared, "blob"):
+            return "blob"
+        case strings.Contains(declared, "real"),
+             strings.Contains(declared, "floa"),
+             strings.Contains(declared, "doub"):
+            return "real"
+    }
+    return "numeric"
+}
+
+// Check every table column is in existing sqlite table with an affinity
+// that stores its values unchanged
+func checkSqliteColumns(name string, existing []sqliteColumn, tinfo *Table) error {
+    for i, column := range tinfo.ColumnNames {
+        found := false
+        for _, e := range existing {
+            if !strings.EqualFold(e.name, column) {
                 continue
             }
-            switch tinfo.ColumnTypes[j] {
+            found = true
+            affinity := sqliteAffinity(e.datatype)
+            ok := false
+            switch tinfo.ColumnTypes[i] {
                 case IntegerDatatype:
-                    queryStr += fmt.Sprintf("%d", value)
-                case StringDatatype:
-                    re, err := regexp.Compile("'")
-                    if err != nil {
-                        return err
-                    }
-                    escaped := re.ReplaceAllString(value.(string), "''")
-                    queryStr += fmt.Sprintf("'%s'", escaped)
+                    ok = affinity == "integer" || affinity == "numeric"
                 case FloatDatatype:
-                    queryStr += fmt.Sprintf("%f", value)
+                    ok = affinity == "real"
+                case StringDatatype:
+                    ok = affinity == "text"
+            }
+            if !ok {
+                return fmt.Errorf(
+                    "StoreTableToSqlite(): column %s of %s is %s, table column is %s",
+                    e.name,
+                    name,
+                    e.datatype,
+                    tinfo.ColumnTypes[i],
+                )
             }
         }
-        queryStr += ");"
-        err = conn.Exec(queryStr)
+        if !found {
+            return fmt.Errorf(
+                "StoreTableToSqlite(): table %s has no column %s",
+                name,
+                column,
+            )
+        }
+    }
+    return nil
+}
+
+// make "verb into name (a,b) values (?,?),(?,?)..." for rows rows
+func insertQuery(name string, columns []string, rows int, conflict string) string {
+    quoted := make([]string, len(columns))
+    for i, column := range columns {
+        quoted[i] = quoteIdentifier(column)
+    }
+    placeholders := "(" + strings.Repeat(",?", len(columns))[1:] + ")"
+    return fmt.Sprintf(
+        "insert into %s (%s) values %s%s;",
+        quoteIdentifier(name),
+        strings.Join(quoted, ","),
+        strings.Repeat("," + placeholders, rows)[1:],
+        conflict,
+    )
+}
+
+func insertTableRows(conn *sqlite.Conn, name string, tinfo *Table,
+                     conflict string, batchRows int) error {
+    cols := len(tinfo.ColumnTypes)
+    var stmt *sqlite.Stmt
+    stmtRows := 0
+    defer func() {
+        if stmt != nil {
+            stmt.Finalize()
+        }
+    }()
+
+    row := make([]*interface{}, cols)
+    for i := 0; i < len(row); i++ {
+        row[i] = new(interface{})
+    }
+    args := make([]interface{}, 0, batchRows * cols)
+    for i := 0; i < tinfo.rowCount(); i += batchRows {
+        n := tinfo.rowCount() - i
+        if n > batchRows {
+            n = batchRows
+        }
+        // full batches share one statement, the last may need its own
+        if stmt == nil || stmtRows != n {
+            if stmt != nil {
+                stmt.Finalize()
+            }
+            queryStr := insertQuery(name, tinfo.ColumnNames, n, conflict)
+            var err error
+            stmt, err = conn.Prepare(queryStr)
+            if err != nil {
+                stmt = nil
+                return fmt.Errorf("StoreTableToSqlite(): %s , %s,", err.Error(), queryStr)
+            }
+            stmtRows = n
+        }
+
+        args = args[:0]
+        for j := i; j < i + n; j++ {
+            err := tinfo.readRow(j, row)
+            if err != nil {
+                return err
+            }
+            for k := 0; k < cols; k++ {
+                args = append(args, *row[k])
+            }
+        }
+        err := stmt.Exec(args...)
+        if err == nil {
+            stmt.Next()
+            err = stmt.Error()
+        }
         if err != nil {
-            return fmt.Errorf("StoreTableToSqlite(): %s , %s,", err.Error(), queryStr)
+            return fmt.Errorf("StoreTableToSqlite(): %s , row %d,", err.Error(), i)
         }
     }
-    
     return nil
 }
 
+// Write table as JSON {"ColumnNames":[...], "ColumnTypes":[...], "Data":[...]}
+// with Data holding an array of values per row. Output is buffered, the
+// first write or row decoding error is returned.
 func (t *Table) JSONWrite(w io.Writer) error {
-    w.Write([]byte("{\"ColumnNames\":"))
-    js,err := json.Marshal(t.ColumnNames)
+    return t.JSONWriteOptions(w, JSONOptions{})
+}
+
+// Write table set as JSON object of table name to table, see
+// Table.JSONWrite
+func (t TableSet) JSONWrite(w io.Writer) error {
+    return t.JSONWriteOptions(w, JSONOptions{})
+}
+
+
+const ndjsonFlushLines = 1000
+
+type errorFlusher interface {
+    Flush() error
+}
+
+type flusher interface {
+    Flush()
+}
+
+// flush writer if it buffers, eg. bufio.Writer or http.ResponseWriter
+func flushWriter(w io.Writer) error {
+    switch f := w.(type) {
+        case errorFlusher:
+            return f.Flush()
+        case flusher:
+            f.Flush()
+    }
+    return nil
+}
+
+func writeLine(w io.Writer, v interface{}) error {
+    js, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(append(js, '\n'))
+    return err
+}
+
+// Write table as newline delimited JSON, a schema line 
+// {"ColumnNames":[...], "ColumnTypes":[...]} followed by one line per row
+// holding an array of the row's values. The writer is flushed as lines are
+// written.
+func (t *Table) NDJSONWrite(w io.Writer) error {
+    return t.NDJSONWriteOptions(w, JSONOptions{})
+}
+
+// NDJSONWrite with values written as JSONWriteOptions writes them, only the
+// NonFinite and LargeIntegers options apply
+func (t *Table) NDJSONWriteOptions(w io.Writer, opts JSONOptions) error {
+    err := opts.check()
+    if err != nil {
+        return err
+    }
+    err = t.checkJSONFinite(opts)
+    if err != nil {
+        return err
+    }
+    err = t.ndjsonWrite(w, opts)
     if err != nil {
         return err
     }
-    w.Write(js)
-    w.Write([]byte(", \"ColumnTypes\":"))
-    js,err = json.Marshal(t.ColumnTypes)
+    return flushWriter(w)
+}
+
+// write row values as a JSON array line
+func writeRowLine(w io.Writer, row []*interface{}, opts JSONOptions) error {
+    buf := []byte{'['}
+    var err error
+    for i, v := range row {
+        if i != 0 {
+            buf = append(buf, ',')
+        }
+        buf, err = appendJSONValue(buf, *v, opts)
+        if err != nil {
+            return err
+        }
+    }
+    _, err = w.Write(append(buf, ']', '\n'))
+    return err
+}
+
+func (t *Table) ndjsonWrite(w io.Writer, opts JSONOptions) error {
+    err := writeLine(w, map[string]interface{}{
+        "ColumnNames" : t.ColumnNames,
+        "ColumnTypes" : t.ColumnTypes,
+    })
     if err != nil {
         return err
-    }                    
-    w.Write(js)
-    w.Write([]byte(", \"Data\":["))
+    }
     row := make([]*interface{}, len(t.ColumnTypes))
     for i := 0; i < len(row); i++ {
         row[i] = new(interface{})
-    }                        
+    }
     for i := 0; i < t.rowCount(); i++ {
-        if i != 0 {
-            w.Write([]byte(","))
+        err = t.readRow(i, row)
+        if err != nil {
+            return err
         }
-        t.readRow(i, row)
-        js,err = json.Marshal(row)
+        err = writeRowLine(w, row, opts)
         if err != nil {
             return err
-        }        
-        w.Write(js) 
+        }
+        if (i + 1) % ndjsonFlushLines == 0 {
+            err = flushWriter(w)
+            if err != nil {
+                return err
+            }
+        }
     }
-    w.Write([]byte("]}"))
     return nil
 }
-        
-func (t TableSet) JSONWrite(w io.Writer) error {
-    w.Write([]byte("{"))
-    i := 0
-    for k, v := range t {
-        if i != 0 {
-            w.Write([]byte(","))
+
+// Write table set as newline delimited JSON, each table is a marker line
+// {"Table":"name"} followed by the table written as by Table.NDJSONWrite
+func (t TableSet) NDJSONWrite(w io.Writer) error {
+    return t.NDJSONWriteOptions(w, JSONOptions{})
+}
+
+// TableSet.NDJSONWrite with values written as by Table.NDJSONWriteOptions
+func (t TableSet) NDJSONWriteOptions(w io.Writer, opts JSONOptions) error {
+    err := opts.check()
+    if err != nil {
+        return err
+    }
+    for _, k := range t.Names() {
+        err = t[k].checkJSONFinite(opts)
+        if err != nil {
+            return err
         }
-        w.Write([]byte("\""))
-        w.Write([]byte(k))
-        w.Write([]byte("\":"))
-        err := v.JSONWrite(w)
+    }
+    for _, k := range t.Names() {
+        err := writeLine(w, map[string]string{"Table" : k})
+        if err != nil {
+            return err
+        }
+        err = t[k].ndjsonWrite(w, opts)
+        if err != nil {
+            return err
+        }
+        err = flushWriter(w)
         if err != nil {
             return err
         }
-        i++
     }
-    w.Write([]byte("}"))
-    return nil
+    return flushWriter(w)
 }
-
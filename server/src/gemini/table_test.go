@@ -6,6 +6,10 @@ import (
     "testing"
     "bytes"
     "io/ioutil"
+    "strings"
+    "encoding/json"
+    "reflect"
+    "errors"
 )
 
 
@@ -81,3 +85,377 @@ func TestStoreTableToSqlite(t *testing.T) {
     fatalOnError(err, t)
 }
 
+
+type countingFlushWriter struct {
+    bytes.Buffer
+    flushes int
+}
+
+func (w *countingFlushWriter) Flush() error {
+    w.flushes++
+    return nil
+}
+
+func TestNDJSONWrite(t *testing.T) {
+    people := &Table{
+        ColumnNames : []string{"name", "age"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, IntegerDatatype},
+    }
+    people.initData()
+    people.writeRow([]interface{}{"tim", 5})
+    people.writeRow([]interface{}{nil, 4})
+
+    var w countingFlushWriter
+    err := TableSet{"people" : people}.NDJSONWrite(&w)
+    fatalOnError(err, t)
+    if w.flushes == 0 {
+        t.Error("writer not flushed")
+    }
+
+    lines := strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n")
+    expected := []string{
+        `{"Table":"people"}`,
+        `{"ColumnNames":["name","age"],"ColumnTypes":["string","integer"]}`,
+        `["tim",5]`,
+        `[null,4]`,
+    }
+    if len(lines) != len(expected) {
+        t.Fatalf("got lines %q", lines)
+    }
+    for i, line := range lines {
+        if line != expected[i] {
+            t.Errorf("line %d %s expected %s", i, line, expected[i])
+        }
+        var v interface{}
+        fatalOnError(json.Unmarshal([]byte(line), &v), t)
+    }
+}
+
+func TestStoreTableToSqliteBatches(t *testing.T) {
+    conn, err := sqlite.Open(":memory:")
+    fatalOnError(err, t)
+    defer conn.Close()
+
+    tableInfo := &Table{
+        ColumnNames : []string{"name", "age", "height"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            IntegerDatatype,
+            FloatDatatype,
+        },
+    }
+    tableInfo.initData()
+    for i := 0; i < 250; i++ {
+        var age interface{}
+        if i % 10 != 0 {
+            age = i
+        }
+        tableInfo.writeRow([]interface{}{"o'neil", age, 1.000000123 + float64(i)})
+    }
+    err = StoreTableToSqliteBatch(conn, "people", tableInfo, 40)
+    fatalOnError(err, t)
+
+    stmt, err := conn.Prepare(
+        "select count(1), count(age), min(height), min(name) from people;",
+    )
+    fatalOnError(err, t)
+    if !stmt.Next() {
+        t.Fatal("no result")
+    }
+    var count, ages int
+    var height float64
+    var name string
+    fatalOnError(stmt.Scan(&count, &ages, &height, &name), t)
+    stmt.Finalize()
+    if count != 250 || ages != 225 {
+        t.Errorf("stored %d rows %d ages, expected 250 225", count, ages)
+    }
+    if height != 1.000000123 {
+        t.Errorf("height stored as %v", height)
+    }
+    if name != "o'neil" {
+        t.Errorf("name stored as %s", name)
+    }
+}
+
+func newSnapshotTable(rows ...[]interface{}) *Table {
+    info := &Table{
+        ColumnNames : []string{"stop_id", "arrivals", "delay"},
+        ColumnTypes : []ColumnDatatype{
+            IntegerDatatype,
+            IntegerDatatype,
+            FloatDatatype,
+        },
+    }
+    info.initData()
+    for _, row := range rows {
+        info.writeRow(row)
+    }
+    return info
+}
+
+func sqliteRows(conn *sqlite.Conn, query string, t *testing.T) [][]interface{} {
+    stmt, err := conn.Prepare(query)
+    fatalOnError(err, t)
+    fatalOnError(stmt.Exec(), t)
+    info, err := LoadTableFromSqlite(stmt)
+    fatalOnError(err, t)
+    rows, err := tableRows(info)
+    fatalOnError(err, t)
+    return rows
+}
+
+func TestStoreTableToSqliteModes(t *testing.T) {
+    conn, err := sqlite.Open(":memory:")
+    fatalOnError(err, t)
+    defer conn.Close()
+
+    first := newSnapshotTable(
+        []interface{}{1, 10, 0.5},
+        []interface{}{2, 20, 1.5},
+    )
+    err = StoreTableToSqliteMode(conn, "snapshots", first, SqliteCreate)
+    fatalOnError(err, t)
+    err = StoreTableToSqliteMode(conn, "snapshots", first, SqliteCreate)
+    if err == nil {
+        t.Error("expected error creating existing table")
+    }
+
+    err = StoreTableToSqliteMode(conn, "snapshots", first, SqliteAppend)
+    fatalOnError(err, t)
+    rows := sqliteRows(conn, "select count(1) from snapshots;", t)
+    if rows[0][0] != int64(4) {
+        t.Errorf("append count %v", rows[0][0])
+    }
+
+    err = StoreTableToSqliteMode(conn, "snapshots", first, SqliteReplace)
+    fatalOnError(err, t)
+    rows = sqliteRows(conn, "select count(1) from snapshots;", t)
+    if rows[0][0] != int64(2) {
+        t.Errorf("replace count %v", rows[0][0])
+    }
+
+    second := newSnapshotTable(
+        []interface{}{2, 25, 2.5},
+        []interface{}{3, 30, nil},
+    )
+    err = StoreTableToSqliteMode(conn, "snapshots", second, SqliteUpsert, "stop_id")
+    fatalOnError(err, t)
+    rows = sqliteRows(
+        conn,
+        "select stop_id, arrivals, ifnull(delay, -1.5) from snapshots order by stop_id;",
+        t,
+    )
+    expected := [][]interface{}{
+        {int64(1), int64(10), 0.5},
+        {int64(2), int64(25), 2.5},
+        {int64(3), int64(30), -1.5},
+    }
+    if !reflect.DeepEqual(rows, expected) {
+        t.Errorf("upsert rows %v expected %v", rows, expected)
+    }
+
+    // upsert creates a missing table
+    err = StoreTableToSqliteMode(conn, "new", second, SqliteUpsert, "stop_id")
+    fatalOnError(err, t)
+    err = StoreTableToSqliteMode(conn, "new", second, SqliteUpsert, "stop_id")
+    fatalOnError(err, t)
+    rows = sqliteRows(conn, "select count(1) from new;", t)
+    if rows[0][0] != int64(2) {
+        t.Errorf("upsert twice count %v", rows[0][0])
+    }
+
+    // columns not stored are kept by upsert
+    fatalOnError(
+        conn.Exec("create table notes (stop_id integer, arrivals int, delay real, note text);"),
+        t,
+    )
+    fatalOnError(conn.Exec("insert into notes values (2, 1, 1.0, 'closed');"), t)
+    err = StoreTableToSqliteMode(conn, "notes", second, SqliteUpsert, "stop_id")
+    fatalOnError(err, t)
+    rows = sqliteRows(conn, "select stop_id, arrivals, ifnull(note, '') from notes order by stop_id;", t)
+    expected = [][]interface{}{
+        {int64(2), int64(25), "closed"},
+        {int64(3), int64(30), ""},
+    }
+    if !reflect.DeepEqual(rows, expected) {
+        t.Errorf("upsert kept rows %v expected %v", rows, expected)
+    }
+}
+
+func TestSqliteKeyIndexName(t *testing.T) {
+    a := sqliteKeyIndexName("t", []string{"a_b", "c"})
+    b := sqliteKeyIndexName("t", []string{"a", "b_c"})
+    c := sqliteKeyIndexName("t_a", []string{"b_c"})
+    if a == b || b == c || a == c {
+        t.Errorf("index names not unique %s %s %s", a, b, c)
+    }
+}
+
+func TestStoreTableToSqliteSchemaErrors(t *testing.T) {
+    conn, err := sqlite.Open(":memory:")
+    fatalOnError(err, t)
+    defer conn.Close()
+
+    fatalOnError(
+        conn.Exec("create table s (stop_id integer, arrivals int, delay text, note text);"),
+        t,
+    )
+    info := newSnapshotTable([]interface{}{1, 10, 0.5})
+
+    // delay stored as text would change its type
+    err = StoreTableToSqliteMode(conn, "s", info, SqliteAppend)
+    if err == nil || !strings.Contains(err.Error(), "delay") {
+        t.Errorf("expected type error, got %v", err)
+    }
+
+    fatalOnError(conn.Exec("create table m (stop_id integer, delay real);"), t)
+    err = StoreTableToSqliteMode(conn, "m", info, SqliteAppend)
+    if err == nil || !strings.Contains(err.Error(), "arrivals") {
+        t.Errorf("expected missing column error, got %v", err)
+    }
+
+    // extra columns in existing table are left NULL
+    fatalOnError(
+        conn.Exec("create table e (note text, Stop_Id integer, arrivals numeric, delay double);"),
+        t,
+    )
+    err = StoreTableToSqliteMode(conn, "e", info, SqliteAppend)
+    fatalOnError(err, t)
+    rows := sqliteRows(conn, "select note is null, stop_id, delay from e;", t)
+    if len(rows) != 1 || rows[0][0] != int64(1) || rows[0][1] != int64(1) || rows[0][2] != 0.5 {
+        t.Errorf("appended rows %v", rows)
+    }
+
+    err = StoreTableToSqliteMode(conn, "e", info, SqliteUpsert)
+    if err == nil {
+        t.Error("expected error for upsert without key")
+    }
+    err = StoreTableToSqliteMode(conn, "e", info, SqliteUpsert, "nope")
+    if err == nil {
+        t.Error("expected error for unknown key column")
+    }
+    err = StoreTableToSqliteMode(conn, "e", info, "merge")
+    if err == nil {
+        t.Error("expected error for unknown mode")
+    }
+}
+
+// writer failing once more than limit bytes have been written
+type failingWriter struct {
+    limit int
+    written int
+}
+
+var errFailingWriter = errors.New("failing writer")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+    if w.written + len(p) > w.limit {
+        n := w.limit - w.written
+        w.written = w.limit
+        return n, errFailingWriter
+    }
+    w.written += len(p)
+    return len(p), nil
+}
+
+func TestJSONWriteErrors(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"name", "age"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, IntegerDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"tim", 5}, {nil, 4}, {"lao", nil}, {"scarlet", 1}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    tables := TableSet{"people" : info}
+    var buf bytes.Buffer
+    fatalOnError(tables.JSONWrite(&buf), t)
+    for limit := 0; limit < buf.Len(); limit += 7 {
+        err := tables.JSONWrite(&failingWriter{limit : limit})
+        if err != errFailingWriter {
+            t.Errorf("limit %d: TableSet error %v", limit, err)
+        }
+        err = info.JSONWrite(&failingWriter{limit : limit})
+        if limit < buf.Len() - len(`{"people":}`) && err != errFailingWriter {
+            t.Errorf("limit %d: Table error %v", limit, err)
+        }
+    }
+
+    // rows larger than the write buffer
+    big := &Table{
+        ColumnNames : []string{"s"},
+        ColumnTypes : []ColumnDatatype{StringDatatype},
+    }
+    big.initData()
+    for i := 0; i < 100; i++ {
+        big.writeRow([]interface{}{strings.Repeat("x", 1000)})
+    }
+    err := big.JSONWrite(&failingWriter{limit : 5000})
+    if err != errFailingWriter {
+        t.Errorf("big table error %v", err)
+    }
+
+    // integer column holding text can't be decoded
+    bad := &Table{
+        ColumnNames : []string{"n"},
+        ColumnTypes : []ColumnDatatype{IntegerDatatype},
+    }
+    bad.initData()
+    bad.writeRow([]interface{}{1})
+    bad.writeRow([]interface{}{"one"})
+    err = bad.JSONWrite(&buf)
+    if err == nil {
+        t.Error("expected row decoding error")
+    }
+    err = TableSet{"bad" : bad}.JSONWrite(&buf)
+    if err == nil {
+        t.Error("expected TableSet row decoding error")
+    }
+}
+
+func TestJSONWriteHostileNames(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{`a"b`, "c\\d", "</script>"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            StringDatatype,
+            IntegerDatatype,
+        },
+    }
+    info.initData()
+    info.writeRow([]interface{}{"\"\n", " ", 1})
+    names := []string{`x"y`, "new\nline", "back\\slash", "<&>", ""}
+    tables := make(TableSet)
+    for _, name := range names {
+        tables[name] = info
+    }
+
+    var buf bytes.Buffer
+    fatalOnError(tables.JSONWrite(&buf), t)
+    var decoded map[string]struct {
+        ColumnNames []string
+        ColumnTypes []ColumnDatatype
+        Data [][]interface{}
+    }
+    err := json.Unmarshal(buf.Bytes(), &decoded)
+    if err != nil {
+        t.Fatalf("invalid JSON %s: %s", err, buf.String())
+    }
+    if len(decoded) != len(names) {
+        t.Fatalf("decoded tables %v", decoded)
+    }
+    for _, name := range names {
+        table, ok := decoded[name]
+        if !ok {
+            t.Errorf("missing table %q", name)
+            continue
+        }
+        if !reflect.DeepEqual(table.ColumnNames, info.ColumnNames) {
+            t.Errorf("%q columns %q", name, table.ColumnNames)
+        }
+        if table.Data[0][0] != "\"\n" || table.Data[0][1] != " " {
+            t.Errorf("%q data %q", name, table.Data)
+        }
+    }
+}
@@ -0,0 +1,275 @@
+package gemini
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Time dimension options of a SourceColumnProperty. The column's dimension
+// table gets extra columns derived from each value, named after the column
+// with the suffixes in timeColumnSuffixes:
+//
+// _time:    seconds since the Unix epoch, or since midnight for TimeOfDay
+// _year:    eg. 2014
+// _quarter: 1 to 4
+// _month:   1 to 12
+// _weekday: 0 (Sunday) to 6
+// _hour:    0 to 23, may be more for TimeOfDay
+// _minute:  0 to 59, rounded down to a multiple of MinuteBucket
+//
+// The columns are for the time in UTC. Rows are sorted chronologically,
+// SortDirection desc gives latest first, and SortExpr is ignored.
+type TimeDimension struct {
+    // layout of string values for time.Parse, TimeLayout if not set.
+    // Integer values are seconds since the Unix epoch (UTC).
+    Layout string
+    // integer values are seconds since midnight, as GTFS stop times, and
+    // the date columns are NULL
+    TimeOfDay bool
+    // minutes per minute bucket, 1 if not set
+    MinuteBucket int
+    // if not 0 rows are added at this interval from the first time to the
+    // last, for times with no rows, giving a continuous time axis. Times
+    // the Layout formats as an existing value are skipped.
+    Fill time.Duration
+}
+
+const TimeLayout = "2006-01-02 15:04:05"
+
+// most rows filling gaps may add to a dimension
+const maxTimeFill = 1000000
+
+var timeColumnSuffixes []string = []string{
+    "_time",
+    "_year",
+    "_quarter",
+    "_month",
+    "_weekday",
+    "_hour",
+    "_minute",
+}
+
+// dimension row with the time of its unique value
+type timeRow struct {
+    // id before sorting, -1 for rows filling gaps
+    id int64
+    values []interface{}
+    seconds int64
+}
+
+type timeOrder struct {
+    rows []*timeRow
+    desc bool
+}
+
+func (o timeOrder) Len() int {
+    return len(o.rows)
+}
+
+func (o timeOrder) Less(i, j int) bool {
+    a, b := o.rows[i], o.rows[j]
+    if a.seconds != b.seconds {
+        return (a.seconds < b.seconds) != o.desc
+    }
+    return a.id < b.id
+}
+
+func (o timeOrder) Swap(i, j int) {
+    o.rows[i], o.rows[j] = o.rows[j], o.rows[i]
+}
+
+// Add the time columns to dimensions of source columns with Time set,
+// sort them chronologically and renumber the fact table's ids. dimDefs
+// and the meta table are updated with the new columns.
+func (d *Datamart) expandTimeDimensions(tables TableSet,
+                                        dimDefs map[string]*DimensionDefinition) error {
+    expanded := false
+    for _, name := range orderedDimNames(dimDefs) {
+        dim := dimDefs[name]
+        opts := d.SourceColumnProperties[dim.UniqueColumn].Time
+        if opts == nil {
+            continue
+        }
+        err := d.expandTimeDimension(tables, name, dim, opts)
+        if err != nil {
+            return fmt.Errorf("expandTimeDimensions() error, %s: %s\n", name, err.Error())
+        }
+        for _, suffix := range timeColumnSuffixes {
+            dim.ExtraColumns = append(dim.ExtraColumns, dim.UniqueColumn + suffix)
+        }
+        dim.SortExpr = quoteIdentifier(dim.UniqueColumn + "_time")
+        expanded = true
+    }
+    if !expanded {
+        return nil
+    }
+    var err error
+    tables[MetaTable], err = metaTable(dimDefs, d.measureColumns())
+    return err
+}
+
+func (d *Datamart) expandTimeDimension(tables TableSet, name string,
+                                       dim *DimensionDefinition, opts *TimeDimension) error {
+    datatype := d.SourceTableData.ColumnTypes[d.SourceTableData.columnIndex(dim.UniqueColumn)]
+    if datatype == FloatDatatype || datatype == StringDatatype && opts.TimeOfDay {
+        return fmt.Errorf("can't make times from %s values", datatype)
+    }
+    layout := opts.Layout
+    if layout == "" {
+        layout = TimeLayout
+    }
+    bucket := int64(opts.MinuteBucket)
+    if bucket == 0 {
+        bucket = 1
+    }
+    if bucket < 0 || opts.Fill < 0 {
+        return fmt.Errorf("negative MinuteBucket or Fill")
+    }
+
+    dimRows, err := tableRows(tables[name])
+    if err != nil {
+        return err
+    }
+    // a dimension without rows has no columns
+    if len(dimRows) == 0 {
+        return nil
+    }
+
+    rows := make([]*timeRow, len(dimRows))
+    // unique values, a Fill finer than the layout formats the same value
+    // for several times
+    seen := make(map[interface{}]bool)
+    for i, row := range dimRows {
+        seconds, err := parseTimeValue(row[1], layout, opts.TimeOfDay)
+        if err != nil {
+            return err
+        }
+        rows[i] = &timeRow{id : int64(i), values : row[1:], seconds : seconds}
+        seen[row[1]] = true
+    }
+
+    if opts.Fill > 0 {
+        step := int64(opts.Fill / time.Second)
+        if step == 0 {
+            step = 1
+        }
+        first, last := rows[0].seconds, rows[0].seconds
+        for _, row := range rows {
+            if row.seconds < first {
+                first = row.seconds
+            }
+            if row.seconds > last {
+                last = row.seconds
+            }
+        }
+        if (last - first) / step > maxTimeFill {
+            return fmt.Errorf("filling %v to %v every %v is too many rows", first, last, opts.Fill)
+        }
+        for seconds := first; seconds <= last; seconds += step {
+            values := make([]interface{}, len(dimRows[0]) - 1)
+            if datatype == StringDatatype {
+                values[0] = time.Unix(seconds, 0).UTC().Format(layout)
+            } else {
+                values[0] = seconds
+            }
+            if seen[values[0]] {
+                continue
+            }
+            seen[values[0]] = true
+            rows = append(rows, &timeRow{id : -1, values : values, seconds : seconds})
+        }
+    }
+    sort.Sort(timeOrder{rows, strings.ToLower(dim.SortDirection) == Desc})
+
+    old := tables[name]
+    info := &Table{
+        ColumnNames : append([]string{}, old.ColumnNames...),
+        ColumnTypes : append([]ColumnDatatype{}, old.ColumnTypes...),
+    }
+    for _, suffix := range timeColumnSuffixes {
+        info.ColumnNames = append(info.ColumnNames, dim.UniqueColumn + suffix)
+        info.ColumnTypes = append(info.ColumnTypes, IntegerDatatype)
+    }
+    info.initData()
+    ids := make([]int64, len(dimRows))
+    for i, row := range rows {
+        if row.id != -1 {
+            ids[row.id] = int64(i)
+        }
+        values := append([]interface{}{int64(i)}, row.values...)
+        values = append(values, timeColumns(row.seconds, opts.TimeOfDay, bucket)...)
+        err = info.writeRow(values)
+        if err != nil {
+            return err
+        }
+    }
+    tables[name] = info
+
+    return renumberFactColumn(tables, dim.IndexColumn, ids)
+}
+
+// seconds since the epoch (or midnight) of a time dimension value
+func parseTimeValue(v interface{}, layout string, timeOfDay bool) (int64, error) {
+    switch v := v.(type) {
+        case int64:
+            if timeOfDay && v < 0 {
+                return 0, fmt.Errorf("negative time of day %d", v)
+            }
+            return v, nil
+        case string:
+            t, err := time.Parse(layout, v)
+            if err != nil {
+                return 0, err
+            }
+            return t.Unix(), nil
+    }
+    return 0, fmt.Errorf("can't make time from %v", v)
+}
+
+// values of the time columns after _time, for a time in UTC
+func timeColumns(seconds int64, timeOfDay bool, bucket int64) []interface{} {
+    if timeOfDay {
+        minute := seconds % 3600 / 60
+        return []interface{}{seconds, nil, nil, nil, nil, seconds / 3600, minute - minute % bucket}
+    }
+    t := time.Unix(seconds, 0).UTC()
+    minute := int64(t.Minute())
+    return []interface{}{
+        seconds,
+        int64(t.Year()),
+        int64((t.Month() - 1) / 3 + 1),
+        int64(t.Month()),
+        int64(t.Weekday()),
+        int64(t.Hour()),
+        minute - minute % bucket,
+    }
+}
+
+// rewrite fact table column of dimension ids with ids[id], -1 is kept
+func renumberFactColumn(tables TableSet, column string, ids []int64) error {
+    fact := tables["fact"]
+    rows, err := tableRows(fact)
+    if err != nil {
+        return err
+    }
+    // a fact table without rows has no columns
+    if len(rows) == 0 {
+        return nil
+    }
+    index := fact.columnIndex(column)
+    info := &Table{ColumnNames : fact.ColumnNames, ColumnTypes : fact.ColumnTypes}
+    info.initData()
+    for _, row := range rows {
+        if id := row[index].(int64); id != -1 {
+            row[index] = ids[id]
+        }
+        err = info.writeRow(row)
+        if err != nil {
+            return err
+        }
+    }
+    tables["fact"] = info
+    return nil
+}
@@ -0,0 +1,209 @@
+package gemini
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestPerformQueriesTimeDimension(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"service_date", "arrival_time", "stop"},
+        ColumnTypes : []ColumnDatatype{StringDatatype, IntegerDatatype, StringDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{
+        {"2014-03-04", 8 * 3600 + 20 * 60, "b"},
+        {"2013-12-31", 25 * 3600 + 5 * 60, "a"},
+        {nil, 8 * 3600 + 44 * 60, "a"},
+        {"2014-03-01", nil, "c"},
+    } {
+        fatalOnError(info.writeRow(row), t)
+    }
+    for _, engine := range []string{SqliteEngine, GoEngine} {
+        d := &Datamart{
+            SourceTableData: info,
+            SourceColumnProperties: map[string]SourceColumnProperty{
+                "service_date" : SourceColumnProperty{
+                    Time: &TimeDimension{Layout: "2006-01-02", Fill: 24 * time.Hour},
+                    SortDirection: "DESC",
+                },
+                "arrival_time" : SourceColumnProperty{
+                    Time: &TimeDimension{TimeOfDay: true, MinuteBucket: 15},
+                },
+            },
+            Engine: engine,
+        }
+        tables, err := d.PerformQueries()
+        fatalOnError(err, t)
+
+        dates := tables["service_dates"]
+        columnNames := []string{
+            "service_date_id", "service_date", "service_date_time",
+            "service_date_year", "service_date_quarter", "service_date_month",
+            "service_date_weekday", "service_date_hour", "service_date_minute",
+        }
+        if !reflect.DeepEqual(dates.ColumnNames, columnNames) {
+            t.Errorf("%s: date columns %v", engine, dates.ColumnNames)
+        }
+        rows, err := tableRows(dates)
+        fatalOnError(err, t)
+        // latest first, filled from 2013-12-31 to 2014-03-04
+        if len(rows) != 64 {
+            t.Fatalf("%s: %d date rows", engine, len(rows))
+        }
+        expected := []interface{}{
+            int64(0), "2014-03-04", int64(1393891200),
+            int64(2014), int64(1), int64(3), int64(2), int64(0), int64(0),
+        }
+        if !reflect.DeepEqual(rows[0], expected) {
+            t.Errorf("%s: first date row %v expected %v", engine, rows[0], expected)
+        }
+        if rows[2][1] != "2014-03-02" || rows[63][1] != "2013-12-31" ||
+           rows[63][4] != int64(4) {
+            t.Errorf("%s: date rows %v %v %v", engine, rows[2], rows[3], rows[63])
+        }
+
+        times, err := tableRows(tables["arrival_times"])
+        fatalOnError(err, t)
+        expectedTimes := [][]interface{}{
+            {int64(0), int64(30000), int64(30000), nil, nil, nil, nil, int64(8), int64(15)},
+            {int64(1), int64(31440), int64(31440), nil, nil, nil, nil, int64(8), int64(30)},
+            {int64(2), int64(90300), int64(90300), nil, nil, nil, nil, int64(25), int64(0)},
+        }
+        if !reflect.DeepEqual(times, expectedTimes) {
+            t.Errorf("%s: time rows %v expected %v", engine, times, expectedTimes)
+        }
+
+        // fact ids follow the renumbered rows
+        fact, err := tableRows(tables["fact"])
+        fatalOnError(err, t)
+        expectedFact := [][]interface{}{
+            {int64(0), int64(0), int64(1)},
+            {int64(63), int64(2), int64(0)},
+            {int64(-1), int64(1), int64(0)},
+            {int64(3), int64(-1), int64(2)},
+        }
+        if !reflect.DeepEqual(fact, expectedFact) {
+            t.Errorf("%s: fact rows %v expected %v", engine, fact, expectedFact)
+        }
+
+        columns, err := tables.FactColumns()
+        fatalOnError(err, t)
+        if columns[0].SortExpr != `"service_date_time"` || len(columns[0].ExtraColumns) != 7 {
+            t.Errorf("%s: meta %+v", engine, columns[0])
+        }
+    }
+}
+
+func TestPerformQueriesTimeDimensionAggregation(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"arrival_time"},
+        ColumnTypes : []ColumnDatatype{IntegerDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{30000}, {90300}, {31440}, {nil}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "arrival_time" : SourceColumnProperty{
+                Time: &TimeDimension{TimeOfDay: true, Fill: time.Hour},
+            },
+        },
+        Aggregation: &Aggregation{
+            Dimensions: []string{"arrival_times"},
+            Aggregates: []Aggregate{{Function: AggregateCount}},
+        },
+    }
+    tables, err := d.PerformQueries()
+    fatalOnError(err, t)
+    times := tables["arrival_times"]
+    if times.rowCount() != 19 || len(times.ColumnNames) != 9 {
+        t.Errorf("times %v %d rows", times.ColumnNames, times.rowCount())
+    }
+    fact, err := tableRows(tables["fact"])
+    fatalOnError(err, t)
+    expected := [][]interface{}{
+        {int64(-1), int64(1)},
+        {int64(0), int64(1)},
+        {int64(1), int64(1)},
+        {int64(18), int64(1)},
+    }
+    if !reflect.DeepEqual(fact, expected) {
+        t.Errorf("fact rows %v expected %v", fact, expected)
+    }
+}
+
+// hourly fill of dates adds each missing date once
+func TestPerformQueriesTimeDimensionFineFill(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"service_date"},
+        ColumnTypes : []ColumnDatatype{StringDatatype},
+    }
+    info.initData()
+    for _, row := range [][]interface{}{{"2014-03-04"}, {"2013-12-31"}, {"2014-03-01"}} {
+        fatalOnError(info.writeRow(row), t)
+    }
+    d := &Datamart{
+        SourceTableData: info,
+        SourceColumnProperties: map[string]SourceColumnProperty{
+            "service_date" : SourceColumnProperty{
+                Time: &TimeDimension{Layout: "2006-01-02", Fill: time.Hour},
+            },
+        },
+    }
+    tables, err := d.PerformQueries()
+    fatalOnError(err, t)
+    dates, err := tableRows(tables["service_dates"])
+    fatalOnError(err, t)
+    // 2013-12-31 to 2014-03-04
+    if len(dates) != 64 {
+        t.Errorf("%d dates", len(dates))
+    }
+    seen := make(map[interface{}]bool)
+    for _, row := range dates {
+        if seen[row[1]] {
+            t.Errorf("duplicate date %v", row[1])
+        }
+        seen[row[1]] = true
+    }
+}
+
+func TestPerformQueriesTimeDimensionErrors(t *testing.T) {
+    info := &Table{
+        ColumnNames : []string{"service_date", "trip", "departure", "departure_hour"},
+        ColumnTypes : []ColumnDatatype{
+            StringDatatype,
+            StringDatatype,
+            IntegerDatatype,
+            IntegerDatatype,
+        },
+    }
+    info.initData()
+    for _, row := range [][]interface{}{
+        {"2014-03-04", "a", 30000, 8},
+        {"2013-12-31", "b", 31440, 8},
+    } {
+        fatalOnError(info.writeRow(row), t)
+    }
+    date := &TimeDimension{Layout: "2006-01-02"}
+    for _, props := range []map[string]SourceColumnProperty{
+        {"service_date" : {Time: &TimeDimension{}}},
+        {"service_date" : {Time: &TimeDimension{Layout: "2006-01-02", TimeOfDay: true}}},
+        {"service_date" : {Time: &TimeDimension{Layout: "2006-01-02", Fill: time.Second}}},
+        {"service_date" : {Time: date, Measure: true}},
+        {"service_date" : {Time: date, PartOfDim: "trips"}},
+        // departure_hour would be made twice
+        {"departure" : {Time: &TimeDimension{TimeOfDay: true}}},
+    } {
+        d := &Datamart{
+            SourceTableData: info,
+            SourceColumnProperties: props,
+        }
+        if _, err := d.PerformQueries(); err == nil {
+            t.Errorf("expected error for %+v", props)
+        }
+    }
+}